@@ -0,0 +1,37 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "time"
+)
+
+// check runs graphite.Client.Check against every Graphite URL, fallbacks
+// included, reporting each result and its latency on w. It returns an
+// error if any of them failed.
+func check(ctx context.Context, graphiteURLs []string, cfg Config, w io.Writer) error {
+    var failed int
+    for _, graphiteURL := range graphiteURLs {
+        client, err := newGraphiteClient([]string{graphiteURL}, cfg)
+        if err != nil {
+            return err
+        }
+
+        start := time.Now()
+        err = client.Check(ctx)
+        elapsed := time.Since(start).Round(time.Millisecond)
+        if err != nil {
+            failed++
+            fmt.Fprintf(w, "FAIL %s after %s: %v\n", graphiteURL, elapsed, err)
+            continue
+        }
+        fmt.Fprintf(w, "OK   %s in %s\n", graphiteURL, elapsed)
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("%d of %d Graphite URLs failed the check", failed, len(graphiteURLs))
+    }
+
+    return nil
+}
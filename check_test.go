@@ -0,0 +1,71 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "testing"
+)
+
+func TestCheck(t *testing.T) {
+    var queries []string
+    ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        queries = append(queries, r.URL.RequestURI())
+        fmt.Fprint(w, `[{"path": "base"}]`)
+    }))
+    defer ok.Close()
+    unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "no", http.StatusUnauthorized)
+    }))
+    defer unauthorized.Close()
+    missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `[]`)
+    }))
+    defer missing.Close()
+
+    tests := []struct {
+        name    string
+        urls    []string
+        want    []string
+        wantErr string
+    }{
+        {"success", []string{ok.URL}, []string{`^OK   ` + regexp.QuoteMeta(ok.URL) + ` in \d+m?s$`}, ""},
+        {"unauthorized", []string{ok.URL, unauthorized.URL}, []string{
+            `^OK   ` + regexp.QuoteMeta(ok.URL) + ` in `,
+            `^FAIL ` + regexp.QuoteMeta(unauthorized.URL) + ` after \d+m?s: .*401`,
+        }, "1 of 2 Graphite URLs failed the check"},
+        {"base dir missing", []string{missing.URL}, []string{`^FAIL ` + regexp.QuoteMeta(missing.URL) + ` after .*: base directory base not found$`}, "1 of 1 Graphite URLs failed the check"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg, err := parseConfig([]string{"-check", "-base-dir", "base"})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            var buf bytes.Buffer
+            err = check(context.Background(), tt.urls, cfg, &buf)
+
+            if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+                t.Errorf("check error = %v, want %q", err, tt.wantErr)
+            }
+            lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+            if len(lines) != len(tt.want) {
+                t.Fatalf("got report:\n%s\nwant %d lines", buf.String(), len(tt.want))
+            }
+            for i, want := range tt.want {
+                if !regexp.MustCompile(want).Match(lines[i]) {
+                    t.Errorf("line %d = %q, want a match for %s", i+1, lines[i], want)
+                }
+            }
+        })
+    }
+
+    if want := "/metrics/find?query=base&format=json"; len(queries) != 2 || queries[0] != want {
+        t.Errorf("queries = %q, want a single %s per check", queries, want)
+    }
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "graphite/graphite"
+)
+
+const (
+    defaultTimeout           = 30 * time.Second
+    defaultConcurrency       = 8
+    defaultServerConcurrency = 4
+    defaultMaxIdleConns      = 100
+    defaultIdleConnTimeout   = 90 * time.Second
+    defaultCacheTTL          = time.Hour
+
+    noDataSkip  = "skip"
+    noDataZero  = "zero"
+    noDataError = "error"
+
+    graphiteURLEnv = "GRAPHITE_URL"
+    passwordEnv    = "GRAPHITE_PASSWORD"
+    tokenEnv       = "GRAPHITE_TOKEN"
+)
+
+type Config struct {
+    GraphiteURL     string
+    BaseDir         string
+    MetricsDirs     []string
+    From            string
+    Until           string
+    Timeout         time.Duration
+    Concurrency     int
+    Retries         int
+    Percentiles     []float64
+    Format          string
+    Output          string
+    Username        string
+    Password        string
+    Token           string
+    CACert          string
+    Insecure        bool
+    LogLevel        slog.Level
+    DryRun          bool
+    ServerQuery     string
+    FullServerPaths bool
+    Include         *regexp.Regexp
+    Exclude         *regexp.Regexp
+    Aggregate       bool
+    SampleStdDev    bool
+    Rate            float64
+    MaxDataPoints   int
+    ConsolidateBy   string
+    FailFast        bool
+    ServersFile     string
+    Progress        bool
+    CacheDir        string
+    CacheTTL        time.Duration
+    RenderFormat    string
+    RequireMetrics  bool
+    Serve           string
+    Version         bool
+    Proxy           *url.URL
+    // MetricKeySegments is the number of trailing path segments used as
+    // the output key of a metric; 0 keeps the full path.
+    MetricKeySegments int
+    TagQueries        []string
+    TagServer         string
+    Deadline          time.Duration
+    Derivative        bool
+    CounterReset      bool
+    ChunkDays         int
+    Quiet             bool
+    Wrap              bool
+    HistogramBuckets  int
+    ServerConcurrency int
+    Sort              string
+    SortDesc          bool
+    OnlyServers       []string
+    MetricTimeout     time.Duration
+    Summary           bool
+    ListServers       bool
+    ListMetrics       bool
+    // Indent is the JSON indentation; empty means compact output.
+    Indent  string
+    Headers http.Header
+    Bucket  time.Duration
+
+    MaxMetricsPerServer int
+    Strict              bool
+    Interval            time.Duration
+    BatchSize           int
+    NoData              string
+    FindFormat          string
+    TargetTemplate      string
+    IncludeDataPoints   bool
+    FollowRedirects     bool
+    CompareFrom         string
+    CompareUntil        string
+    MaxIdleConns        int
+    // MaxIdleConnsPerHost of 0 keeps up to Concurrency idle connections
+    // per host, enough for every request in flight to reuse one.
+    MaxIdleConnsPerHost int
+    IdleConnTimeout     time.Duration
+    MetricsAllowlist    string
+    ValidateSchema      bool
+    Window              time.Duration
+    WindowStat          string
+    GzipOutput          bool
+    SkipEmptyServers    bool
+    Trim                float64
+    Mode                bool
+    NoNullPoints        bool
+    EWMA                float64
+    Check               bool
+    StateFile           string
+    // Labels maps a server to the labels attached to each of its metrics.
+    Labels map[string]map[string]string
+}
+
+func parseConfig(args []string) (Config, error) {
+    var cfg Config
+
+    fs := flag.NewFlagSet("graphite", flag.ContinueOnError)
+    fs.StringVar(&cfg.GraphiteURL, "graphite-url", "", "Graphite base URL, or a comma-separated list tried in order on connection errors and 5xx responses (defaults to $"+graphiteURLEnv+")")
+    fs.StringVar(&cfg.BaseDir, "base-dir", graphite.DefaultBaseDir, "Graphite metric prefix under which servers are discovered; ${VAR} is expanded from the environment")
+    metricsDirs := fs.String("metrics-dir", graphite.DefaultMetricsDir, "comma-separated sub-directories under each server holding its metrics")
+    fs.StringVar(&cfg.From, "from", graphite.DefaultFrom, "start of the /render time range: now, a relative offset such as -7d, YYYYMMDD, a Unix epoch, an RFC 3339 timestamp or any other Graphite time, which is passed on unchecked")
+    fs.StringVar(&cfg.Until, "until", graphite.DefaultUntil, "end of the /render time range")
+    fs.StringVar(&cfg.StateFile, "state-file", "", "fetch only data newer than the previous run recorded in this file, falling back to -from on the first run, and record each complete run")
+    fs.StringVar(&cfg.CompareFrom, "compare-from", "", "start of a second time range each metric is compared against, reported as a delta")
+    fs.StringVar(&cfg.CompareUntil, "compare-until", "", "end of the -compare-from time range")
+    fs.StringVar(&cfg.FindFormat, "find-format", graphite.DefaultFindFormat, "format requested from /metrics/find, e.g. json, treejson or completer; node lists and {\"metrics\": [...]} responses are both understood")
+    fs.StringVar(&cfg.RenderFormat, "render-format", graphite.RenderFormatJSON, "format requested from /render: json, raw or csv")
+    fs.BoolVar(&cfg.ValidateSchema, "validate-schema", false, "reject /render responses that do not strictly match the expected json series shape instead of parsing them leniently")
+    fs.IntVar(&cfg.ChunkDays, "chunk-days", 0, "split the time range into /render requests of at most this many days (0 means one request)")
+    fs.StringVar(&cfg.TargetTemplate, "target-template", "", "wrap each /render target in this Graphite expression, with %s standing for the metric path, e.g. 'summarize(%s,\"1h\",\"max\")'")
+    fs.BoolVar(&cfg.IncludeDataPoints, "include-datapoints", false, "attach the datapoints each metric's statistics were computed from to its output entry")
+    fs.IntVar(&cfg.BatchSize, "batch-size", 1, "number of metrics fetched per /render request; above 1, targets are sent in a POST body")
+    fs.IntVar(&cfg.MaxDataPoints, "max-datapoints", 0, "maxDataPoints passed to /render (0 means unset)")
+    fs.BoolVar(&cfg.NoNullPoints, "no-null-points", false, "ask /render to leave out null datapoints (noNullPoints=true); null_count and completeness then only reflect nulls it still returns")
+    fs.StringVar(&cfg.ConsolidateBy, "consolidate-by", "", "consolidateBy function applied to each target: sum, average, min, max, first or last")
+    fs.StringVar(&cfg.CacheDir, "cache-dir", "", "cache /render responses in this directory")
+    fs.DurationVar(&cfg.CacheTTL, "cache-ttl", defaultCacheTTL, "maximum age of a cached /render response (0 means never expire)")
+    fs.DurationVar(&cfg.Timeout, "timeout", defaultTimeout, "timeout for each HTTP request to Graphite")
+    fs.DurationVar(&cfg.Deadline, "deadline", 0, "overall time budget for the run; partial results are written when it expires (0 means none)")
+    fs.IntVar(&cfg.Concurrency, "concurrency", defaultConcurrency, "maximum Graphite requests in flight, shared by all servers processed in parallel")
+    fs.IntVar(&cfg.ServerConcurrency, "server-concurrency", defaultServerConcurrency, "number of servers processed in parallel")
+    fs.IntVar(&cfg.MaxIdleConns, "max-idle-conns", defaultMaxIdleConns, "maximum idle HTTP connections kept open across all hosts (0 means no limit)")
+    fs.IntVar(&cfg.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "maximum idle HTTP connections kept open per host (0 means the -concurrency value)")
+    fs.DurationVar(&cfg.IdleConnTimeout, "idle-conn-timeout", defaultIdleConnTimeout, "how long an idle HTTP connection is kept open (0 means forever)")
+    fs.Float64Var(&cfg.Rate, "rate", 0, "maximum Graphite requests per second (0 means unlimited)")
+    fs.DurationVar(&cfg.MetricTimeout, "metric-timeout", 0, "time budget for fetching a single metric, including retries (0 means no limit)")
+    fs.IntVar(&cfg.Retries, "retries", graphite.DefaultRetries, "number of retries for transient HTTP failures (429, 5xx and network errors)")
+    fs.StringVar(&cfg.Format, "format", formatJSON, "output format: json, csv, ndjson, prometheus or table")
+    fs.StringVar(&cfg.Indent, "indent", "  ", "indentation of -format json output; spaces and tabs only")
+    compact := fs.Bool("compact", false, "write -format json output on a single line without indentation")
+    fs.BoolVar(&cfg.Wrap, "wrap", false, "with -format json, nest results under a versioned object with schema_version, generated_at, base_dir and servers")
+    fs.StringVar(&cfg.Sort, "sort", "", "order servers by name, average, max or count instead of discovery order; statistics are taken over all of a server's metrics")
+    fs.BoolVar(&cfg.SortDesc, "desc", false, "with -sort, order servers in descending order")
+    fs.StringVar(&cfg.Output, "output", "", "write results to this file instead of stdout")
+    labelsFile := fs.String("labels-file", "", "JSON file mapping server names to labels, e.g. {\"s1\": {\"team\": \"network\"}}, attached to every metric of the server, as extra columns in csv and table output")
+    fs.BoolVar(&cfg.SkipEmptyServers, "skip-empty-servers", false, "leave servers without any metric statistics out of the output")
+    fs.BoolVar(&cfg.GzipOutput, "gzip-output", false, "gzip-compress the -output file, appending .gz to its name if missing")
+    fs.StringVar(&cfg.Username, "username", "", "username for HTTP basic auth")
+    fs.StringVar(&cfg.Password, "password", "", "password for HTTP basic auth (defaults to $"+passwordEnv+")")
+    fs.StringVar(&cfg.Token, "token", "", "bearer token sent in the Authorization header (defaults to $"+tokenEnv+")")
+    fs.StringVar(&cfg.CACert, "ca-cert", "", "PEM file with CA certificates used to verify Graphite's TLS certificate")
+    fs.BoolVar(&cfg.Insecure, "insecure", false, "skip TLS certificate verification (testing only)")
+    fs.BoolVar(&cfg.FollowRedirects, "follow-redirects", true, "follow HTTP redirects from Graphite; when false a redirect fails the request")
+    onlyServers := fs.String("only-servers", "", "comma-separated servers to process; others discovered or listed in -servers-file are skipped")
+    fs.StringVar(&cfg.ServersFile, "servers-file", "", "read server names from this file (one per line) instead of discovering them")
+    fs.Func("tag-query", "discover series with /tags/findSeries using this expression instead of /metrics/find (repeatable)", func(expr string) error {
+        cfg.TagQueries = append(cfg.TagQueries, expr)
+        return nil
+    })
+    fs.Func("header", "extra \"Key: Value\" header sent with every Graphite request (repeatable)", func(header string) error {
+        key, value, ok := strings.Cut(header, ":")
+        key = strings.TrimSpace(key)
+        if !ok || key == "" {
+            return fmt.Errorf("must be \"Key: Value\", got %q", header)
+        }
+        switch http.CanonicalHeaderKey(key) {
+        case "Authorization", "Accept-Encoding":
+            return fmt.Errorf("%s cannot be set with -header", key)
+        }
+        if cfg.Headers == nil {
+            cfg.Headers = http.Header{}
+        }
+        cfg.Headers.Add(key, strings.TrimSpace(value))
+        return nil
+    })
+    fs.StringVar(&cfg.TagServer, "tag-server", "host", "tag whose value groups -tag-query series into servers")
+    fs.StringVar(&cfg.ServerQuery, "server-query", "", "glob used to discover servers (default \"<base-dir>.*\")")
+    fs.BoolVar(&cfg.FullServerPaths, "server-full-path", false, "identify servers by their full metric path instead of the last segment; needed when -server-query matches below base-dir")
+    fs.BoolVar(&cfg.Aggregate, "aggregate", false, "append an \"_aggregate\" entry with per-metric statistics across all servers")
+    fs.IntVar(&cfg.MaxMetricsPerServer, "max-metrics-per-server", 0, "process at most this many metrics per server, in discovery order (0 means unlimited)")
+    fs.StringVar(&cfg.NoData, "no-data", noDataSkip, "what to do with a metric without usable datapoints: skip it, report it with zero counts (zero), or count it as a failure (error)")
+    fs.BoolVar(&cfg.Strict, "strict", false, "fail a metric when any datapoint lacks a value or timestamp instead of skipping it")
+    fs.BoolVar(&cfg.RequireMetrics, "require-metrics", false, "count a server without any metrics as a failure")
+    fs.BoolVar(&cfg.Quiet, "quiet", false, "suppress per-server and per-metric error messages; failures are still counted and summarized")
+    fs.BoolVar(&cfg.FailFast, "fail-fast", false, "abort the run on the first failed fetch or parse, writing no output")
+    fs.BoolVar(&cfg.Summary, "summary", false, "write a summary of servers, metrics, datapoints, errors and duration to stderr when done")
+    fs.BoolVar(&cfg.Progress, "progress", true, "report \"processed N/M servers\" on stderr while running")
+    fs.DurationVar(&cfg.Interval, "interval", 0, "run continuously, taking a snapshot at this interval until interrupted; with -output each snapshot gets a timestamped file")
+    fs.StringVar(&cfg.Serve, "serve", "", "listen on this address (e.g. :8080) and serve /statistics and /healthz instead of running once")
+    fs.BoolVar(&cfg.Version, "version", false, "print version information and exit")
+    fs.BoolVar(&cfg.ListServers, "list-servers", false, "print the discovered servers and exit without fetching any datapoints")
+    fs.BoolVar(&cfg.ListMetrics, "list-metrics", false, "print the metric paths of every discovered server and exit without fetching any datapoints")
+    fs.BoolVar(&cfg.Check, "check", false, "send one /metrics/find request for -base-dir to each Graphite URL, report the latency and exit 1 if any failed")
+    fs.BoolVar(&cfg.DryRun, "dry-run", false, "discover servers and metrics, then print the /render URLs that would be fetched instead of fetching them; no output is written")
+    proxy := fs.String("proxy", "", "HTTP proxy URL for Graphite requests (default from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)")
+    metricKey := fs.String("metric-key", "last", "output key for each metric: last (final path segment), full (entire path) or N (last N segments)")
+    fs.StringVar(&cfg.MetricsAllowlist, "metrics-allowlist", "", "only fetch metrics whose full path is listed in this file (one per line), in addition to -include and -exclude")
+    include := fs.String("include", "", "only fetch metrics whose full path matches this regular expression")
+    exclude := fs.String("exclude", "", "skip metrics whose full path matches this regular expression")
+    fs.IntVar(&cfg.HistogramBuckets, "histogram", 0, "include an N-bucket equal-width histogram between each metric's minimum and maximum (0 disables)")
+    bucket := fs.String("bucket", "", "also compute statistics per time bucket of this size, e.g. 1h or 1d, keyed by bucket start")
+    fs.DurationVar(&cfg.Window, "window", 0, "also report the highest and lowest -window-stat over every sliding window of this size, e.g. 5m (0 disables)")
+    fs.StringVar(&cfg.WindowStat, "window-stat", graphite.WindowAverage, "statistic computed over each -window: average or sum")
+    fs.BoolVar(&cfg.Derivative, "derivative", false, "compute statistics over the deltas between successive datapoints")
+    fs.BoolVar(&cfg.CounterReset, "counter-reset", false, "with -derivative, treat negative deltas as counter resets and clamp them to 0")
+    stddev := fs.String("stddev", "population", "standard deviation: population (divide by n) or sample (divide by n-1)")
+    logLevel := fs.String("log-level", "info", "log level: debug, info, warn or error")
+    fs.Float64Var(&cfg.Trim, "trim", 0, "also report a trimmed average that discards the lowest and highest P percent of each metric's values (0 disables)")
+    fs.BoolVar(&cfg.Mode, "mode", false, "also report the most frequent value of each metric, the smallest one on ties")
+    fs.Float64Var(&cfg.EWMA, "ewma", 0, "also report the exponentially weighted moving average of each metric with this smoothing factor in (0, 1] (0 disables)")
+    percentiles := fs.String("percentiles", "", "comma-separated percentiles to compute, e.g. 50,95,99")
+    configFile := fs.String("config", "", "JSON or YAML file of flag settings keyed by flag name; flags given on the command line take precedence. YAML is limited to flat \"key: value\" lines, lists and # comments")
+
+    if err := fs.Parse(args); err != nil {
+        return Config{}, err
+    }
+    if *configFile != "" {
+        if err := applyConfigFile(fs, *configFile); err != nil {
+            return Config{}, err
+        }
+    }
+
+    if cfg.GraphiteURL == "" {
+        cfg.GraphiteURL = os.Getenv(graphiteURLEnv)
+    }
+    // Only flags can conflict: the environment fills in credentials for the
+    // authentication method the flags chose, or for neither.
+    if cfg.Token != "" && (cfg.Username != "" || cfg.Password != "") {
+        return Config{}, fmt.Errorf("-token cannot be combined with -username/-password")
+    }
+    basicAuth := cfg.Username != "" || cfg.Password != ""
+    if cfg.Password == "" && cfg.Token == "" {
+        cfg.Password = os.Getenv(passwordEnv)
+    }
+    if cfg.Token == "" && !basicAuth {
+        cfg.Token = os.Getenv(tokenEnv)
+    }
+    if cfg.Token != "" && cfg.Password != "" {
+        return Config{}, fmt.Errorf("%s and %s cannot both be set without -username or -token", passwordEnv, tokenEnv)
+    }
+
+    if err := cfg.LogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+        return Config{}, fmt.Errorf("invalid -log-level %q", *logLevel)
+    }
+
+    switch *stddev {
+    case "population":
+    case "sample":
+        cfg.SampleStdDev = true
+    default:
+        return Config{}, fmt.Errorf("-stddev must be population or sample, got %q", *stddev)
+    }
+
+    cfg.MetricsDirs = splitList(*metricsDirs)
+    cfg.OnlyServers = splitList(*onlyServers)
+    if len(cfg.MetricsDirs) == 0 {
+        return Config{}, fmt.Errorf("-metrics-dir must not be empty")
+    }
+
+    var err error
+    cfg.Percentiles, err = parsePercentiles(*percentiles)
+    if err != nil {
+        return Config{}, err
+    }
+
+    cfg.MetricKeySegments, err = parseMetricKey(*metricKey)
+    if err != nil {
+        return Config{}, err
+    }
+
+    if *labelsFile != "" {
+        if cfg.Labels, err = readLabelsFile(*labelsFile); err != nil {
+            return Config{}, fmt.Errorf("invalid -labels-file: %v", err)
+        }
+    }
+
+    if *bucket != "" {
+        if cfg.Bucket, err = parseBucket(*bucket); err != nil {
+            return Config{}, err
+        }
+    }
+
+    cfg.BaseDir, err = expandEnv(cfg.BaseDir)
+    if err != nil {
+        return Config{}, fmt.Errorf("invalid -base-dir: %v", err)
+    }
+
+    if *proxy != "" {
+        cfg.Proxy, err = url.Parse(*proxy)
+        if err != nil || cfg.Proxy.Scheme == "" || cfg.Proxy.Host == "" {
+            return Config{}, fmt.Errorf("invalid -proxy %q: must be an absolute URL", *proxy)
+        }
+    }
+
+    if *include != "" {
+        if cfg.Include, err = regexp.Compile(*include); err != nil {
+            return Config{}, fmt.Errorf("invalid -include pattern: %v", err)
+        }
+    }
+    if *exclude != "" {
+        if cfg.Exclude, err = regexp.Compile(*exclude); err != nil {
+            return Config{}, fmt.Errorf("invalid -exclude pattern: %v", err)
+        }
+    }
+
+    if strings.TrimSpace(cfg.From) == "" {
+        return Config{}, fmt.Errorf("-from must not be empty")
+    }
+    if strings.TrimSpace(cfg.Until) == "" {
+        return Config{}, fmt.Errorf("-until must not be empty")
+    }
+    now := time.Now()
+    if cfg.From, cfg.Until, err = timeRange("-from", "-until", cfg.From, cfg.Until, now); err != nil {
+        return Config{}, err
+    }
+    cfg.CompareFrom = strings.TrimSpace(cfg.CompareFrom)
+    cfg.CompareUntil = strings.TrimSpace(cfg.CompareUntil)
+    if (cfg.CompareFrom == "") != (cfg.CompareUntil == "") {
+        return Config{}, fmt.Errorf("-compare-from and -compare-until must be set together")
+    }
+    if cfg.comparing() {
+        if cfg.CompareFrom, cfg.CompareUntil, err = timeRange("-compare-from", "-compare-until", cfg.CompareFrom, cfg.CompareUntil, now); err != nil {
+            return Config{}, err
+        }
+    }
+    if _, err := graphite.ParserFor(cfg.RenderFormat); err != nil {
+        return Config{}, fmt.Errorf("invalid -render-format: %v", err)
+    }
+    if cfg.ValidateSchema && cfg.RenderFormat != graphite.RenderFormatJSON {
+        return Config{}, fmt.Errorf("-validate-schema requires -render-format=json")
+    }
+    if cfg.ChunkDays < 0 {
+        return Config{}, fmt.Errorf("-chunk-days must not be negative")
+    }
+    if cfg.MaxDataPoints < 0 {
+        return Config{}, fmt.Errorf("-max-datapoints must not be negative")
+    }
+    switch cfg.ConsolidateBy {
+    case "", "sum", "average", "avg", "min", "max", "first", "last":
+    default:
+        return Config{}, fmt.Errorf("invalid -consolidate-by %q", cfg.ConsolidateBy)
+    }
+    if cfg.ServersFile != "" {
+        if _, err := os.Stat(cfg.ServersFile); err != nil {
+            return Config{}, fmt.Errorf("invalid -servers-file: %v", err)
+        }
+    }
+    if cfg.MetricsAllowlist != "" {
+        if _, err := os.Stat(cfg.MetricsAllowlist); err != nil {
+            return Config{}, fmt.Errorf("invalid -metrics-allowlist: %v", err)
+        }
+    }
+    if cfg.CacheTTL < 0 {
+        return Config{}, fmt.Errorf("-cache-ttl must not be negative")
+    }
+    if cfg.Deadline < 0 {
+        return Config{}, fmt.Errorf("-deadline must not be negative")
+    }
+    if cfg.MetricTimeout < 0 {
+        return Config{}, fmt.Errorf("-metric-timeout must not be negative")
+    }
+    if cfg.Timeout < 0 {
+        return Config{}, fmt.Errorf("-timeout must not be negative")
+    }
+    if cfg.Concurrency < 1 {
+        return Config{}, fmt.Errorf("-concurrency must be at least 1")
+    }
+    if cfg.ServerConcurrency < 1 {
+        return Config{}, fmt.Errorf("-server-concurrency must be at least 1")
+    }
+    if cfg.MaxIdleConns < 0 {
+        return Config{}, fmt.Errorf("-max-idle-conns must not be negative")
+    }
+    if cfg.MaxIdleConnsPerHost < 0 {
+        return Config{}, fmt.Errorf("-max-idle-conns-per-host must not be negative")
+    }
+    if cfg.IdleConnTimeout < 0 {
+        return Config{}, fmt.Errorf("-idle-conn-timeout must not be negative")
+    }
+    if cfg.Rate < 0 {
+        return Config{}, fmt.Errorf("-rate must not be negative")
+    }
+    switch cfg.NoData {
+    case noDataSkip, noDataZero, noDataError:
+    default:
+        return Config{}, fmt.Errorf("-no-data must be skip, zero or error, got %q", cfg.NoData)
+    }
+    if cfg.TargetTemplate != "" && strings.Count(cfg.TargetTemplate, "%s") != 1 {
+        return Config{}, fmt.Errorf("-target-template must contain exactly one %%s, got %q", cfg.TargetTemplate)
+    }
+    if cfg.BatchSize < 1 {
+        return Config{}, fmt.Errorf("-batch-size must be at least 1")
+    }
+    if cfg.MaxMetricsPerServer < 0 {
+        return Config{}, fmt.Errorf("-max-metrics-per-server must not be negative")
+    }
+    if cfg.Window < 0 || cfg.Window%time.Second != 0 {
+        return Config{}, fmt.Errorf("-window must be a positive whole number of seconds, got %s", cfg.Window)
+    }
+    switch cfg.WindowStat {
+    case graphite.WindowAverage, graphite.WindowSum:
+    default:
+        return Config{}, fmt.Errorf("invalid -window-stat %q: must be average or sum", cfg.WindowStat)
+    }
+    if cfg.Trim < 0 || cfg.Trim >= 50 {
+        return Config{}, fmt.Errorf("-trim must be at least 0 and below 50, got %v", cfg.Trim)
+    }
+    if cfg.EWMA < 0 || cfg.EWMA > 1 {
+        return Config{}, fmt.Errorf("-ewma must be in (0, 1], got %v", cfg.EWMA)
+    }
+    if cfg.HistogramBuckets < 0 {
+        return Config{}, fmt.Errorf("-histogram must not be negative")
+    }
+    if cfg.Retries < 0 {
+        return Config{}, fmt.Errorf("-retries must not be negative")
+    }
+    switch cfg.Format {
+    case formatJSON, formatCSV, formatNDJSON, formatPrometheus, formatTable:
+    default:
+        return Config{}, fmt.Errorf("-format must be json, csv, ndjson, prometheus or table, got %q", cfg.Format)
+    }
+    switch cfg.Sort {
+    case "", sortName, sortAverage, sortMax, sortCount:
+    default:
+        return Config{}, fmt.Errorf("-sort must be name, average, max or count, got %q", cfg.Sort)
+    }
+    if cfg.SortDesc && cfg.Sort == "" {
+        return Config{}, fmt.Errorf("-desc requires -sort")
+    }
+    if cfg.Interval < 0 {
+        return Config{}, fmt.Errorf("-interval must not be negative")
+    }
+    if cfg.Interval > 0 && (cfg.Serve != "" || cfg.ListServers || cfg.ListMetrics) {
+        return Config{}, fmt.Errorf("-interval cannot be combined with -serve, -list-servers or -list-metrics")
+    }
+    if cfg.Check && (cfg.Serve != "" || cfg.ListServers || cfg.ListMetrics || cfg.Interval > 0 || cfg.DryRun) {
+        return Config{}, fmt.Errorf("-check cannot be combined with -serve, -list-servers, -list-metrics, -interval or -dry-run")
+    }
+    if cfg.StateFile != "" && (cfg.Serve != "" || cfg.ListServers || cfg.ListMetrics || cfg.Check) {
+        return Config{}, fmt.Errorf("-state-file cannot be combined with -serve, -list-servers, -list-metrics or -check")
+    }
+    if cfg.ListServers && cfg.ListMetrics {
+        return Config{}, fmt.Errorf("-list-servers and -list-metrics cannot be combined")
+    }
+    if (cfg.ListServers || cfg.ListMetrics) && cfg.Serve != "" {
+        return Config{}, fmt.Errorf("-list-servers and -list-metrics cannot be combined with -serve")
+    }
+    if strings.Trim(cfg.Indent, " \t") != "" {
+        return Config{}, fmt.Errorf("-indent must contain only spaces and tabs")
+    }
+    if *compact {
+        cfg.Indent = ""
+    }
+    if cfg.Wrap && cfg.Format != formatJSON {
+        return Config{}, fmt.Errorf("-wrap requires -format json")
+    }
+    if cfg.GzipOutput && cfg.Output == "" {
+        return Config{}, fmt.Errorf("-gzip-output requires -output")
+    }
+
+    return cfg, nil
+}
+
+// timeRange normalizes a from/until flag pair with graphite.NormalizeTime
+// and checks that the range is not empty or inverted.
+func timeRange(fromFlag, untilFlag, from, until string, now time.Time) (string, string, error) {
+    from, err := graphite.NormalizeTime(from)
+    if err != nil {
+        return "", "", fmt.Errorf("invalid %s: %v", fromFlag, err)
+    }
+    until, err = graphite.NormalizeTime(until)
+    if err != nil {
+        return "", "", fmt.Errorf("invalid %s: %v", untilFlag, err)
+    }
+    if err := graphite.ValidateRange(from, until, now); err != nil {
+        return "", "", fmt.Errorf("invalid %s/%s range: %v", fromFlag, untilFlag, err)
+    }
+
+    return from, until, nil
+}
+
+func splitList(list string) []string {
+    var items []string
+    for _, field := range strings.Split(list, ",") {
+        field = strings.TrimSpace(field)
+        if field != "" {
+            items = append(items, field)
+        }
+    }
+
+    return items
+}
+
+// envReference matches a ${VAR} reference to an environment variable.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in value with the variable from the
+// process environment. Other uses of $ are left as they are. It is an
+// error to reference a variable that is not set.
+func expandEnv(value string) (string, error) {
+    var missing []string
+    expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+        name := envReference.FindStringSubmatch(ref)[1]
+        v, ok := os.LookupEnv(name)
+        if !ok {
+            missing = append(missing, name)
+        }
+        return v
+    })
+    if len(missing) > 0 {
+        return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+    }
+
+    return expanded, nil
+}
+
+// normalizeBaseURLs applies normalizeBaseURL to each entry of a
+// comma-separated list of base URLs.
+func normalizeBaseURLs(list string) ([]string, error) {
+    var urls []string
+    for _, raw := range splitList(list) {
+        u, err := normalizeBaseURL(raw)
+        if err != nil {
+            return nil, err
+        }
+        urls = append(urls, u)
+    }
+    if len(urls) == 0 {
+        return nil, fmt.Errorf("no Graphite URL given")
+    }
+
+    return urls, nil
+}
+
+// normalizeBaseURL validates a Graphite base URL and strips trailing
+// slashes so paths such as "/render" can be appended directly.
+func normalizeBaseURL(raw string) (string, error) {
+    u, err := url.Parse(strings.TrimSpace(raw))
+    if err != nil {
+        return "", fmt.Errorf("invalid Graphite URL %q: %v", raw, err)
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return "", fmt.Errorf("invalid Graphite URL %q: scheme must be http or https", raw)
+    }
+    if u.Host == "" {
+        return "", fmt.Errorf("invalid Graphite URL %q: missing host", raw)
+    }
+    if u.RawQuery != "" || u.Fragment != "" {
+        return "", fmt.Errorf("invalid Graphite URL %q: must not contain a query or fragment", raw)
+    }
+
+    return strings.TrimRight(u.String(), "/"), nil
+}
+
+func parseMetricKey(value string) (int, error) {
+    switch value {
+    case "last":
+        return 1, nil
+    case "full":
+        return 0, nil
+    }
+
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 1 {
+        return 0, fmt.Errorf("invalid -metric-key %q: must be last, full or a positive number", value)
+    }
+
+    return n, nil
+}
+
+// parseBucket parses a -bucket size: a Go duration or a number of days
+// such as "1d", in whole seconds.
+func parseBucket(value string) (time.Duration, error) {
+    var size time.Duration
+    if days, ok := strings.CutSuffix(value, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil {
+            return 0, fmt.Errorf("invalid -bucket %q", value)
+        }
+        size = time.Duration(n) * 24 * time.Hour
+    } else {
+        var err error
+        if size, err = time.ParseDuration(value); err != nil {
+            return 0, fmt.Errorf("invalid -bucket %q", value)
+        }
+    }
+
+    if size < time.Second || size%time.Second != 0 {
+        return 0, fmt.Errorf("-bucket must be a positive whole number of seconds, got %q", value)
+    }
+
+    return size, nil
+}
+
+func parsePercentiles(list string) ([]float64, error) {
+    var percentiles []float64
+
+    for _, field := range splitList(list) {
+        p, err := strconv.ParseFloat(field, 64)
+        // Written this way round, the check also rejects NaN.
+        if err != nil || !(p >= 0 && p <= 100) {
+            return nil, fmt.Errorf("invalid percentile %q: must be a number between 0 and 100", field)
+        }
+        percentiles = append(percentiles, p)
+    }
+
+    return percentiles, nil
+}
+
+// comparing reports whether every metric is also fetched over the
+// -compare-from window.
+func (cfg Config) comparing() bool {
+    return cfg.CompareFrom != ""
+}
+
+func (cfg Config) statsOptions() graphite.StatsOptions {
+    return graphite.StatsOptions{
+        Percentiles:       cfg.Percentiles,
+        SampleStdDev:      cfg.SampleStdDev,
+        HistogramBuckets:  cfg.HistogramBuckets,
+        Strict:            cfg.Strict,
+        IncludeDataPoints: cfg.IncludeDataPoints,
+        Trim:              cfg.Trim,
+        Mode:              cfg.Mode,
+        EWMA:              cfg.EWMA,
+    }
+}
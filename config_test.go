@@ -0,0 +1,214 @@
+package main
+
+import (
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestAuthFromEnvironment(t *testing.T) {
+    tests := []struct {
+        name         string
+        args         []string
+        env          map[string]string
+        wantPassword string
+        wantToken    string
+        wantErr      string
+    }{
+        {"token from env", nil, map[string]string{tokenEnv: "t"}, "", "t", ""},
+        {"token flag beats env password", []string{"-token", "t"}, map[string]string{passwordEnv: "p"}, "", "t", ""},
+        {"username flag beats env token", []string{"-username", "u"}, map[string]string{passwordEnv: "p", tokenEnv: "t"}, "p", "", ""},
+        {"both flags", []string{"-token", "t", "-username", "u"}, nil, "", "", "-token cannot be combined"},
+        {"both env", nil, map[string]string{passwordEnv: "p", tokenEnv: "t"}, "", "", "cannot both be set"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv(passwordEnv, "")
+            t.Setenv(tokenEnv, "")
+            for k, v := range tt.env {
+                t.Setenv(k, v)
+            }
+
+            cfg, err := parseConfig(tt.args)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("parseConfig error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if cfg.Password != tt.wantPassword || cfg.Token != tt.wantToken {
+                t.Errorf("password = %q, token = %q, want %q and %q", cfg.Password, cfg.Token, tt.wantPassword, tt.wantToken)
+            }
+        })
+    }
+}
+
+func TestNormalizeBaseURL(t *testing.T) {
+    tests := []struct {
+        raw     string
+        want    string
+        wantErr string
+    }{
+        {"http://graphite:8080", "http://graphite:8080", ""},
+        {"https://graphite.example.com/", "https://graphite.example.com", ""},
+        {" http://graphite/graphite// ", "http://graphite/graphite", ""},
+        {"graphite:8080", "", "scheme must be http or https"},
+        {"ftp://graphite", "", "scheme must be http or https"},
+        {"http://", "", "missing host"},
+        {"http://graphite/?a=b", "", "must not contain a query or fragment"},
+    }
+
+    for _, tt := range tests {
+        got, err := normalizeBaseURL(tt.raw)
+        if tt.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("normalizeBaseURL(%q) error = %v, want %q", tt.raw, err, tt.wantErr)
+            }
+            continue
+        }
+        if err != nil || got != tt.want {
+            t.Errorf("normalizeBaseURL(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+        }
+    }
+}
+
+func TestNormalizeBaseURLs(t *testing.T) {
+    got, err := normalizeBaseURLs("http://a/, http://b")
+    if err != nil || len(got) != 2 || got[0] != "http://a" || got[1] != "http://b" {
+        t.Errorf("normalizeBaseURLs = %q, %v, want [http://a http://b]", got, err)
+    }
+    if _, err := normalizeBaseURLs(" , "); err == nil {
+        t.Error("normalizeBaseURLs accepted an empty list")
+    }
+}
+
+func TestGraphiteURLFromEnvironment(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        env  string
+        want string
+    }{
+        {"env", nil, "http://env:8080", "http://env:8080"},
+        {"flag beats env", []string{"-graphite-url", "http://flag"}, "http://env:8080", "http://flag"},
+        {"neither", nil, "", ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv(graphiteURLEnv, tt.env)
+
+            cfg, err := parseConfig(tt.args)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if cfg.GraphiteURL != tt.want {
+                t.Errorf("GraphiteURL = %q, want %q", cfg.GraphiteURL, tt.want)
+            }
+        })
+    }
+}
+
+func TestExpandEnv(t *testing.T) {
+    t.Setenv("GGM_TEST_DC", "ams1")
+    t.Setenv("GGM_TEST_EMPTY", "")
+
+    tests := []struct {
+        value   string
+        want    string
+        wantErr string
+    }{
+        {"telegraf.${GGM_TEST_DC}.servers", "telegraf.ams1.servers", ""},
+        {"${GGM_TEST_DC}${GGM_TEST_EMPTY}", "ams1", ""},
+        {"cost$5 and $GGM_TEST_DC", "cost$5 and $GGM_TEST_DC", ""},
+        {"${GGM_TEST_UNSET}.${GGM_TEST_UNSET2}", "", "environment variable GGM_TEST_UNSET, GGM_TEST_UNSET2 is not set"},
+    }
+
+    for _, tt := range tests {
+        got, err := expandEnv(tt.value)
+        if tt.wantErr != "" {
+            if err == nil || err.Error() != tt.wantErr {
+                t.Errorf("expandEnv(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+            }
+            continue
+        }
+        if err != nil || got != tt.want {
+            t.Errorf("expandEnv(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+        }
+    }
+}
+
+func TestBaseDirExpansion(t *testing.T) {
+    t.Setenv("GGM_TEST_DC", "ams1")
+
+    cfg, err := parseConfig([]string{"-base-dir", "telegraf.${GGM_TEST_DC}"})
+    if err != nil || cfg.BaseDir != "telegraf.ams1" {
+        t.Errorf("BaseDir = %q, %v, want telegraf.ams1", cfg.BaseDir, err)
+    }
+    if _, err := parseConfig([]string{"-base-dir", "telegraf.${GGM_TEST_UNSET}"}); err == nil {
+        t.Error("parseConfig accepted an unset variable in -base-dir")
+    }
+}
+
+func TestTimeRangeValidation(t *testing.T) {
+    tests := []struct {
+        args      []string
+        wantFrom  string
+        wantUntil string
+        wantErr   string
+    }{
+        {[]string{"-from", "-1h", "-until", "-5min"}, "-1h", "-5min", ""},
+        {[]string{"-from", "2023-11-14T22:13:20Z", "-until", "1700003600"}, "1700000000", "1700003600", ""},
+        {[]string{"-from", "now", "-until", "-1d"}, "", "", "invalid -from/-until range"},
+        {[]string{"-from", "midnight", "-until", "16:00_20240102"}, "midnight", "16:00_20240102", ""},
+        {[]string{"-from", "-1d2h", "-until", "yesterday"}, "-1d2h", "yesterday", ""},
+        {[]string{"-from", "-1q"}, "", "", "invalid -from"},
+        {[]string{"-compare-from", "-1d", "-compare-until", "-2d"}, "", "", "invalid -compare-from/-compare-until range"},
+    }
+
+    for _, tt := range tests {
+        cfg, err := parseConfig(tt.args)
+        if tt.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("parseConfig(%q) error = %v, want one containing %q", tt.args, err, tt.wantErr)
+            }
+            continue
+        }
+        if err != nil || cfg.From != tt.wantFrom || cfg.Until != tt.wantUntil {
+            t.Errorf("parseConfig(%q) = %q, %q, %v, want %q, %q", tt.args, cfg.From, cfg.Until, err, tt.wantFrom, tt.wantUntil)
+        }
+    }
+}
+
+func TestEWMAFlag(t *testing.T) {
+    for _, alpha := range []string{"-0.1", "1.5"} {
+        if _, err := parseConfig([]string{"-ewma", alpha}); err == nil || !strings.Contains(err.Error(), "-ewma must be in (0, 1]") {
+            t.Errorf("-ewma %s: error = %v, want it rejected", alpha, err)
+        }
+    }
+    for _, alpha := range []string{"0", "0.2", "1"} {
+        if _, err := parseConfig([]string{"-ewma", alpha}); err != nil {
+            t.Errorf("-ewma %s: %v", alpha, err)
+        }
+    }
+}
+
+func TestPercentilesFlag(t *testing.T) {
+    for _, list := range []string{"-1", "100.5", "NaN", "Inf", "-Inf", "50,nan", "p95"} {
+        if _, err := parseConfig([]string{"-percentiles", list}); err == nil || !strings.Contains(err.Error(), "must be a number between 0 and 100") {
+            t.Errorf("-percentiles %s: error = %v, want it rejected", list, err)
+        }
+    }
+
+    cfg, err := parseConfig([]string{"-percentiles", "0, 50,99.9,100"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []float64{0, 50, 99.9, 100}; !slices.Equal(cfg.Percentiles, want) {
+        t.Errorf("Percentiles = %v, want %v", cfg.Percentiles, want)
+    }
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// configEntry is one setting from a -config file: a flag name and the
+// values to set it to, more than one for repeatable flags.
+type configEntry struct {
+    key    string
+    values []string
+}
+
+// applyConfigFile sets every flag named in the file at path that was not
+// given on the command line, so that flags override the file. Keys are
+// flag names without the leading dash; unknown keys are an error.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+    entries, err := readConfigFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read config file: %v", err)
+    }
+
+    set := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+    for _, entry := range entries {
+        if entry.key == "config" || fs.Lookup(entry.key) == nil {
+            return fmt.Errorf("%s: unknown key %q", path, entry.key)
+        }
+        if set[entry.key] {
+            continue
+        }
+        if len(entry.values) > 1 && !repeatableFlags[entry.key] {
+            return fmt.Errorf("%s: %s takes a single value, got a list of %d", path, entry.key, len(entry.values))
+        }
+        for _, value := range entry.values {
+            if err := fs.Set(entry.key, value); err != nil {
+                return fmt.Errorf("%s: invalid value %q for %s: %v", path, value, entry.key, err)
+            }
+        }
+    }
+
+    return nil
+}
+
+// repeatableFlags are the flags that accumulate their values when set more
+// than once rather than keeping the last, and so may be given a list.
+var repeatableFlags = map[string]bool{
+    "tag-query": true,
+    "header":    true,
+}
+
+func readConfigFile(path string) ([]configEntry, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        return parseJSONConfig(data)
+    case ".yaml", ".yml":
+        return parseYAMLConfig(data)
+    default:
+        return nil, fmt.Errorf("%s: unsupported config file type, want .json, .yaml or .yml", path)
+    }
+}
+
+// parseJSONConfig reads a JSON object whose values are strings, numbers,
+// booleans or, for repeatable flags, arrays of those.
+func parseJSONConfig(data []byte) ([]configEntry, error) {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+
+    var object map[string]any
+    if err := dec.Decode(&object); err != nil {
+        return nil, fmt.Errorf("invalid JSON: %v", err)
+    }
+
+    keys := make([]string, 0, len(object))
+    for key := range object {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    var entries []configEntry
+    for _, key := range keys {
+        items, ok := object[key].([]any)
+        if !ok {
+            items = []any{object[key]}
+        }
+
+        entry := configEntry{key: key}
+        for _, item := range items {
+            switch v := item.(type) {
+            case string:
+                entry.values = append(entry.values, v)
+            case json.Number:
+                entry.values = append(entry.values, v.String())
+            case bool:
+                entry.values = append(entry.values, strconv.FormatBool(v))
+            default:
+                return nil, fmt.Errorf("%s: value must be a string, number, boolean or array of those", key)
+            }
+        }
+        entries = append(entries, entry)
+    }
+
+    return entries, nil
+}
+
+// parseYAMLConfig reads the flat subset of YAML needed for flag values:
+// "key: value" lines, where a value may be quoted, and lists, either
+// "[a, b]" flow sequences or block lists of "- value" lines under a key
+// with no value of its own. '#' starts a comment, at the start of a line
+// or after a value. Anchors, multi-line strings and nested mappings are
+// not supported.
+func parseYAMLConfig(data []byte) ([]configEntry, error) {
+    var entries []configEntry
+    var list *configEntry
+
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for n := 1; scanner.Scan(); n++ {
+        line := scanner.Text()
+        trimmed := strings.TrimSpace(line)
+        if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+            continue
+        }
+
+        if item, ok := strings.CutPrefix(trimmed, "- "); ok {
+            if list == nil {
+                return nil, fmt.Errorf("line %d: list item outside of a list", n)
+            }
+            value, err := yamlScalar(item)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", n, err)
+            }
+            list.values = append(list.values, value)
+            continue
+        }
+
+        if list != nil && len(list.values) == 0 {
+            return nil, fmt.Errorf("%s has no value", list.key)
+        }
+        list = nil
+
+        key, value, ok := strings.Cut(trimmed, ":")
+        if !ok || line != trimmed {
+            return nil, fmt.Errorf("line %d: want \"key: value\"", n)
+        }
+        key = strings.TrimSpace(key)
+        value = strings.TrimSpace(value)
+
+        entries = append(entries, configEntry{key: key})
+        if value == "" {
+            list = &entries[len(entries)-1]
+            continue
+        }
+
+        values, err := yamlValues(value)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", n, err)
+        }
+        if len(values) == 0 {
+            return nil, fmt.Errorf("%s has no value", key)
+        }
+        entries[len(entries)-1].values = values
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if list != nil && len(list.values) == 0 {
+        return nil, fmt.Errorf("%s has no value", list.key)
+    }
+
+    return entries, nil
+}
+
+// yamlValues parses the value of a "key: value" line: a scalar, or a
+// "[a, b]" flow sequence of scalars.
+func yamlValues(value string) ([]string, error) {
+    if !strings.HasPrefix(value, "[") {
+        scalar, err := yamlScalar(value)
+        if err != nil {
+            return nil, err
+        }
+        return []string{scalar}, nil
+    }
+
+    end := yamlQuoteAware(value, ']')
+    if end < 0 {
+        return nil, fmt.Errorf("unterminated list %s", value)
+    }
+    if err := yamlTrailer(value[end+1:]); err != nil {
+        return nil, err
+    }
+
+    var values []string
+    items := strings.TrimSpace(value[1:end])
+    for items != "" {
+        item, rest := items, ""
+        if comma := yamlQuoteAware(items, ','); comma >= 0 {
+            item, rest = items[:comma], items[comma+1:]
+        }
+        items = strings.TrimSpace(rest)
+        scalar, err := yamlScalar(strings.TrimSpace(item))
+        if err != nil {
+            return nil, err
+        }
+        values = append(values, scalar)
+    }
+
+    return values, nil
+}
+
+// yamlQuoteAware returns the index of the first sep in s outside of a
+// quoted value, or -1.
+func yamlQuoteAware(s string, sep byte) int {
+    var quote byte
+    for i := 0; i < len(s); i++ {
+        switch c := s[i]; {
+        case quote == '"' && c == '\\':
+            i++
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case c == sep:
+            return i
+        }
+    }
+
+    return -1
+}
+
+// yamlClosingQuote returns the index of the quote closing the quoted value
+// s starts with, or -1.
+func yamlClosingQuote(s string) int {
+    quote := s[0]
+    for i := 1; i < len(s); i++ {
+        switch {
+        case quote == '"' && s[i] == '\\':
+            i++
+        case s[i] != quote:
+        case quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+            i++
+        default:
+            return i
+        }
+    }
+
+    return -1
+}
+
+// yamlTrailer checks that nothing but a comment follows a quoted value or
+// a list.
+func yamlTrailer(rest string) error {
+    if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+        return fmt.Errorf("unexpected %q after value", rest)
+    }
+
+    return nil
+}
+
+// yamlScalar unquotes a single- or double-quoted value and strips a
+// trailing " #" comment, which may follow the closing quote.
+func yamlScalar(value string) (string, error) {
+    if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+        end := yamlClosingQuote(value)
+        if end < 0 {
+            return "", fmt.Errorf("unterminated quoted value %s", value)
+        }
+        if err := yamlTrailer(value[end+1:]); err != nil {
+            return "", err
+        }
+        if value[0] == '"' {
+            return strconv.Unquote(value[:end+1])
+        }
+        return strings.ReplaceAll(value[1:end], "''", "'"), nil
+    }
+
+    if i := strings.Index(value, " #"); i >= 0 {
+        value = strings.TrimSpace(value[:i])
+    }
+
+    return value, nil
+}
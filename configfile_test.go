@@ -0,0 +1,113 @@
+package main
+
+import (
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestConfigFile(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        content string
+    }{
+        {"json", "config.json", `{
+    "base-dir": "foo.bar",
+    "metrics-dir": "cpu,mem",
+    "from": "-1d",
+    "until": "-1h",
+    "concurrency": 3,
+    "username": "svc",
+    "tag-query": ["env=prod", "dc=ams1"]
+}`},
+        {"yaml", "config.yaml", `# nightly snapshot
+base-dir: foo.bar
+metrics-dir: "cpu,mem"  # quoted
+from: '-1d'
+until: -1h
+concurrency: 3
+username: svc
+tag-query:
+  - env=prod
+  - dc=ams1
+`},
+        {"yaml flow list", "config.yml", `base-dir: foo.bar
+metrics-dir: cpu,mem
+from: -1d
+until: -1h
+concurrency: 3 # default is higher
+username: svc
+tag-query: ["env=prod", dc=ams1] # both
+`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := writeFile(t, tt.file, tt.content)
+
+            cfg, err := parseConfig([]string{"-config", path, "-until", "now"})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if cfg.BaseDir != "foo.bar" || !slices.Equal(cfg.MetricsDirs, []string{"cpu", "mem"}) {
+                t.Errorf("base dir, metrics dirs = %q, %q, want foo.bar, [cpu mem]", cfg.BaseDir, cfg.MetricsDirs)
+            }
+            if cfg.From != "-1d" || cfg.Until != "now" {
+                t.Errorf("from, until = %q, %q, want -1d and the -until flag, now", cfg.From, cfg.Until)
+            }
+            if cfg.Concurrency != 3 || cfg.Username != "svc" {
+                t.Errorf("concurrency, username = %d, %q, want 3, svc", cfg.Concurrency, cfg.Username)
+            }
+            if !slices.Equal(cfg.TagQueries, []string{"env=prod", "dc=ams1"}) {
+                t.Errorf("tag queries = %q, want [env=prod dc=ams1]", cfg.TagQueries)
+            }
+        })
+    }
+}
+
+func TestConfigFileRepeatableFlags(t *testing.T) {
+    path := writeFile(t, "config.json", `{"header": ["X-Team: ops", "X-Env: prod"]}`)
+
+    cfg, err := parseConfig([]string{"-config", path})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Headers.Get("X-Team") != "ops" || cfg.Headers.Get("X-Env") != "prod" {
+        t.Errorf("headers = %v, want X-Team and X-Env", cfg.Headers)
+    }
+}
+
+func TestConfigFileInvalid(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        content string
+        wantErr string
+    }{
+        {"unknown json key", "config.json", `{"base-dirs": "foo"}`, `unknown key "base-dirs"`},
+        {"unknown yaml key", "config.yaml", "base-dirs: foo\n", `unknown key "base-dirs"`},
+        {"config key", "config.json", `{"config": "other.json"}`, `unknown key "config"`},
+        {"json list for single value", "config.json", `{"from": ["-1d", "-2d"]}`, "from takes a single value, got a list of 2"},
+        {"yaml list for single value", "config.yaml", "from: [-1d, -2d]\n", "from takes a single value, got a list of 2"},
+        {"json object value", "config.json", `{"from": {"a": 1}}`, "value must be a string"},
+        {"invalid value", "config.yaml", "concurrency: many\n", `invalid value "many" for concurrency`},
+        {"junk after quote", "config.yaml", "from: \"-1d\" x\n", `unexpected "x" after value`},
+        {"unterminated list", "config.yaml", "tag-query: [a, b\n", "unterminated list"},
+        {"empty block list", "config.yaml", "tag-query:\nfrom: -1d\n", "tag-query has no value"},
+        {"indented key", "config.yaml", "  from: -1d\n", `want "key: value"`},
+        {"unsupported type", "config.toml", "from = \"-1d\"\n", "unsupported config file type"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := writeFile(t, tt.file, tt.content)
+
+            _, err := parseConfig([]string{"-config", path})
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+            }
+        })
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "sort"
+    "sync"
+)
+
+// failure is one problem reported by a worker: a log record together with
+// the server and metric it concerns, when known.
+type failure struct {
+    level  slog.Level
+    msg    string
+    args   []any
+    server string
+    metric string
+}
+
+// failureLog collects the failures of concurrent workers so that they are
+// logged together once the run is over, ordered by server, metric and
+// message, instead of interleaved in whatever order they happened.
+type failureLog struct {
+    mu       sync.Mutex
+    failures []failure
+}
+
+func (l *failureLog) add(level slog.Level, msg string, args ...any) {
+    f := failure{level: level, msg: msg, args: args}
+    for i := 0; i+1 < len(args); i += 2 {
+        switch args[i] {
+        case "server":
+            f.server = fmt.Sprint(args[i+1])
+        case "metric", "first":
+            f.metric = fmt.Sprint(args[i+1])
+        }
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.failures = append(l.failures, f)
+}
+
+// flush logs every failure collected so far and forgets them.
+func (l *failureLog) flush() {
+    l.mu.Lock()
+    failures := l.failures
+    l.failures = nil
+    l.mu.Unlock()
+
+    sort.SliceStable(failures, func(i, j int) bool {
+        a, b := failures[i], failures[j]
+        if a.server != b.server {
+            return a.server < b.server
+        }
+        if a.metric != b.metric {
+            return a.metric < b.metric
+        }
+        if a.msg != b.msg {
+            return a.msg < b.msg
+        }
+        return fmt.Sprint(a.args...) < fmt.Sprint(b.args...)
+    })
+
+    for _, f := range failures {
+        slog.Log(context.Background(), f.level, f.msg, f.args...)
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "log/slog"
+    "reflect"
+    "regexp"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// logTime matches the time attribute of a slog text record.
+var logTime = regexp.MustCompile(`(?m)^time=\S+ `)
+
+func TestFailureLogOrder(t *testing.T) {
+    failures := []struct {
+        level slog.Level
+        msg   string
+        args  []any
+    }{
+        {slog.LevelError, "fetch failed", []any{"server", "s2", "metric", "b"}},
+        {slog.LevelError, "statistics failed", []any{"metric", "a", "server", "s1"}},
+        {slog.LevelError, "fetch failed", []any{"server", "s1", "metric", "b"}},
+        {slog.LevelWarn, "server has no metrics", []any{"server", "s3"}},
+        {slog.LevelError, "fetch failed", []any{"server", "s1", "metric", "a", "error", "500"}},
+        {slog.LevelError, "batch fetch failed", []any{"server", "s1", "metrics", 2, "first", "a"}},
+        {slog.LevelError, "fetch failed", []any{"metric", "c"}},
+        {slog.LevelError, "fetch failed", []any{"server", "s1", "metric", "a", "error", "404"}},
+    }
+    want := []string{
+        `level=ERROR msg="fetch failed" metric=c`,
+        `level=ERROR msg="batch fetch failed" server=s1 metrics=2 first=a`,
+        `level=ERROR msg="fetch failed" server=s1 metric=a error=404`,
+        `level=ERROR msg="fetch failed" server=s1 metric=a error=500`,
+        `level=ERROR msg="statistics failed" metric=a server=s1`,
+        `level=ERROR msg="fetch failed" server=s1 metric=b`,
+        `level=ERROR msg="fetch failed" server=s2 metric=b`,
+        `level=WARN msg="server has no metrics" server=s3`,
+    }
+
+    for i := 0; i < 20; i++ {
+        logs := captureLogs(t)
+        var l failureLog
+        var wg sync.WaitGroup
+        for _, f := range failures {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                l.add(f.level, f.msg, f.args...)
+            }()
+        }
+        wg.Wait()
+        l.flush()
+
+        got := strings.Split(strings.TrimSuffix(logTime.ReplaceAllString(logs.String(), ""), "\n"), "\n")
+        if !reflect.DeepEqual(got, want) {
+            t.Fatalf("run %d logged:\n%s\nwant:\n%s", i+1, strings.Join(got, "\n"), strings.Join(want, "\n"))
+        }
+    }
+}
+
+func TestFailureLogFlushForgets(t *testing.T) {
+    logs := captureLogs(t)
+    var l failureLog
+    l.add(slog.LevelError, "fetch failed", "metric", "a")
+    l.flush()
+    l.flush()
+
+    if n := strings.Count(logs.String(), "fetch failed"); n != 1 {
+        t.Errorf("logged %d times over two flushes, want 1:\n%s", n, logs)
+    }
+}
+
+func TestConcurrentFailuresReportedInOrder(t *testing.T) {
+    series := map[string]string{}
+    var targets []string
+    for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+        series[name] = "[[1, 100]]"
+        targets = append(targets, "base.s1.snmp."+name)
+    }
+    f := singleServer(series)
+    srv := newFakeGraphite(t, f)
+    srv.Config.Handler = failing(f, targets...)
+
+    for i := 0; i < 3; i++ {
+        logs := captureLogs(t)
+        _, failures, err := run(t, srv.URL, "-base-dir", "base", "-retries", "0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if failures != int64(len(targets)) {
+            t.Errorf("failures = %d, want %d", failures, len(targets))
+        }
+
+        var got []string
+        for _, m := range regexp.MustCompile(`msg="fetch failed".* metric=(\S+)`).FindAllStringSubmatch(logs.String(), -1) {
+            got = append(got, m[1])
+        }
+        if !reflect.DeepEqual(got, targets) {
+            t.Errorf("run %d: failures logged for %q, want %q", i+1, got, targets)
+        }
+    }
+}
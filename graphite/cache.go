@@ -0,0 +1,68 @@
+package graphite
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// Cache stores raw /render responses keyed by request URL.
+type Cache interface {
+    Get(key string) ([]byte, bool)
+    Put(key string, body []byte) error
+}
+
+// DiskCache is a Cache backed by one file per key in Dir. Entries older
+// than TTL are treated as missing; a zero TTL never expires entries.
+type DiskCache struct {
+    Dir string
+    TTL time.Duration
+}
+
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+    path := d.path(key)
+
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, false
+    }
+    if d.TTL > 0 && time.Since(info.ModTime()) > d.TTL {
+        return nil, false
+    }
+
+    body, err := os.ReadFile(path)
+    if err != nil {
+        return nil, false
+    }
+
+    return body, true
+}
+
+func (d *DiskCache) Put(key string, body []byte) error {
+    if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(d.Dir, "render-*.tmp")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(body); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+
+    return os.Rename(tmp.Name(), d.path(key))
+}
+
+func (d *DiskCache) path(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return filepath.Join(d.Dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,91 @@
+package graphite
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDiskCache(t *testing.T) {
+    var renders atomic.Int64
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        renders.Add(1)
+        fmt.Fprint(w, `[{"target": "cpu", "datapoints": [[1, 100]]}]`)
+    }))
+    defer srv.Close()
+
+    dir := t.TempDir()
+    client := NewClient(srv.URL, srv.Client())
+    client.Cache = &DiskCache{Dir: dir, TTL: time.Hour}
+
+    fetch := func() {
+        t.Helper()
+        dataPoints, err := client.Data(context.Background(), "cpu")
+        if err != nil || len(dataPoints) != 1 {
+            t.Fatalf("Data = %v, %v, want one series", dataPoints, err)
+        }
+    }
+
+    fetch()
+    fetch()
+    if n := renders.Load(); n != 1 {
+        t.Errorf("%d requests for two fetches, want the second served from cache", n)
+    }
+
+    // Entries older than the TTL are fetched again.
+    entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil || len(entries) != 1 {
+        t.Fatalf("cache entries = %q, %v, want one", entries, err)
+    }
+    old := time.Now().Add(-2 * time.Hour)
+    if err := os.Chtimes(entries[0], old, old); err != nil {
+        t.Fatal(err)
+    }
+    fetch()
+    if n := renders.Load(); n != 2 {
+        t.Errorf("%d requests after the entry expired, want 2", n)
+    }
+}
+
+func TestDiskCacheChunks(t *testing.T) {
+    var requests int
+    srv := windowServer(t, &requests)
+    client := NewClient(srv.URL, srv.Client())
+    client.Cache = &DiskCache{Dir: t.TempDir(), TTL: time.Hour}
+    client.ChunkSize = 24 * time.Hour
+
+    // The same three days, as -from -3d resolves ten minutes apart.
+    for _, from := range []int64{1700000000, 1700000600} {
+        requests = 0
+        until := from + 3*24*3600
+        if _, err := client.DataIn(context.Background(), "cpu", strconv.FormatInt(from, 10), strconv.FormatInt(until, 10)); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Only the partial first and last days miss; both full days between
+    // them are served from the first run's entries.
+    if requests != 2 {
+        t.Errorf("%d requests for the second run, want 2", requests)
+    }
+}
+
+func TestDiskCacheMiss(t *testing.T) {
+    cache := &DiskCache{Dir: filepath.Join(t.TempDir(), "missing")}
+    if _, ok := cache.Get("key"); ok {
+        t.Error("Get of an empty cache hit")
+    }
+    if err := cache.Put("key", []byte("body")); err != nil {
+        t.Fatal(err)
+    }
+    if body, ok := cache.Get("key"); !ok || string(body) != "body" {
+        t.Errorf("Get = %q, %t, want body", body, ok)
+    }
+}
@@ -0,0 +1,876 @@
+// Package graphite fetches metrics from a Graphite HTTP API and computes
+// summary statistics over the returned datapoints.
+package graphite
+
+import (
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand/v2"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    DefaultBaseDir    = "telegraf.vsphere_metrics.oob.qa.dell"
+    DefaultMetricsDir = "snmp"
+    DefaultFrom       = "-7d"
+    DefaultUntil      = "now"
+    DefaultRetries    = 3
+    DefaultFindFormat = "json"
+
+    retryBaseDelay = 500 * time.Millisecond
+    retryMaxDelay  = 10 * time.Second
+
+    // maxRetryAfter caps the wait requested by a 429 Retry-After header.
+    maxRetryAfter = time.Minute
+)
+
+// Client queries a Graphite instance, optionally backed by standbys.
+type Client struct {
+    BaseURL    string
+    HTTPClient *http.Client
+
+    // Fallbacks are base URLs tried in order, with the same path and
+    // query, when a request to BaseURL fails with a connection error or a
+    // 5xx response.
+    Fallbacks []string
+
+    BaseDir    string
+    MetricsDir string
+    From       string
+    Until      string
+    Retries    int
+
+    // Rate, when positive, is the most requests per second sent to
+    // Graphite, shared by every goroutine using the client. Waiting for a
+    // slot does not count against the HTTPClient timeout.
+    Rate float64
+
+    // ChunkSize, when positive, splits [From, Until] into windows of at
+    // most this size that are fetched separately and merged. Windows end
+    // on multiples of ChunkSize, so full ones keep their cache entries
+    // from run to run.
+    ChunkSize time.Duration
+
+    // RenderFormat is the /render format parameter; see ParserFor.
+    RenderFormat string
+    // ValidateSchema makes json responses that do not strictly match the
+    // expected series shape an error; see JSONParser.
+    ValidateSchema bool
+
+    // TargetTemplate, when set, wraps every metric in a Graphite function
+    // call before it is sent to /render: its "%s" is replaced with the
+    // metric path, e.g. `summarize(%s,"1h","max")`.
+    TargetTemplate string
+
+    // MaxDataPoints and ConsolidateBy are passed to /render when set.
+    MaxDataPoints int
+    ConsolidateBy string
+    // NoNullPoints asks /render to leave out null datapoints. Backends
+    // that ignore it are reported once; nulls are skipped either way.
+    NoNullPoints bool
+
+    // FindFormat is the /metrics/find format parameter. Responses are
+    // accepted in any of the shapes handled by parseFindResponse.
+    FindFormat string
+
+    // ServerQuery overrides the /metrics/find glob used for server
+    // discovery; empty means BaseDir + ".*".
+    ServerQuery string
+    // FullServerPaths makes ServerList return full metric paths rather than
+    // the last path segment; MetricsList then treats server as that path.
+    FullServerPaths bool
+
+    // Include and Exclude filter the metric paths returned by MetricsList.
+    // A nil pattern matches everything; Exclude wins over Include.
+    Include *regexp.Regexp
+    Exclude *regexp.Regexp
+    // Allowlist, when non-nil, further restricts MetricsList to exactly
+    // the paths it contains.
+    Allowlist map[string]bool
+
+    Username string
+    Password string
+    Token    string
+
+    // UserAgent and Header are sent with every request. Header must not
+    // set Authorization or Accept-Encoding, which the client manages.
+    UserAgent string
+    Header    http.Header
+
+    // Cache, when set, is consulted before every /render request and
+    // updated with fresh responses.
+    Cache Cache
+
+    // DryRun, when set, receives the URL of each /render request instead
+    // of the request being sent, and every render returns no data.
+    // Discovery requests are read-only and are still sent.
+    DryRun io.Writer
+
+    // Logger receives debug output for every request; nil means slog.Default().
+    Logger *slog.Logger
+
+    retries         atomic.Int64
+    nullPointsNoted sync.Once
+
+    rateMu      sync.Mutex
+    nextRequest time.Time
+}
+
+// NewClient returns a Client for baseURL using the package defaults. A nil
+// httpClient means http.DefaultClient.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+    if httpClient == nil {
+        httpClient = http.DefaultClient
+    }
+
+    return &Client{
+        BaseURL:    baseURL,
+        HTTPClient: httpClient,
+        BaseDir:    DefaultBaseDir,
+        MetricsDir: DefaultMetricsDir,
+        From:       DefaultFrom,
+        Until:      DefaultUntil,
+        Retries:    DefaultRetries,
+
+        RenderFormat: RenderFormatJSON,
+        FindFormat:   DefaultFindFormat,
+    }
+}
+
+// Check sends a single /metrics/find request for BaseDir itself, without
+// retries or failover, to verify that BaseURL is reachable, accepts the
+// credentials and knows BaseDir.
+func (c *Client) Check(ctx context.Context) error {
+    body, _, err := c.sendOnce(ctx, c.findURL(c.BaseDir), nil)
+    if err != nil {
+        return err
+    }
+
+    nodes, err := parseFindResponse(body)
+    if err != nil {
+        return err
+    }
+    if len(nodes) == 0 {
+        return fmt.Errorf("base directory %s not found", c.BaseDir)
+    }
+
+    return nil
+}
+
+// ServerList returns the names of the servers matched by ServerQuery.
+func (c *Client) ServerList(ctx context.Context) ([]string, error) {
+    query := c.ServerQuery
+    if query == "" {
+        query = c.BaseDir + ".*"
+    }
+    url := c.findURL(query)
+
+    body, err := c.get(ctx, url)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch server list: %w", err)
+    }
+
+    servers, err := parseFindResponse(body)
+    if err != nil {
+        return nil, err
+    }
+
+    var serverNames []string
+    for _, server := range servers {
+        if c.FullServerPaths {
+            serverNames = append(serverNames, server)
+            continue
+        }
+        parts := strings.Split(server, ".")
+        serverNames = append(serverNames, parts[len(parts)-1])
+    }
+
+    return serverNames, nil
+}
+
+// MetricsList returns the full paths of the metrics under server's MetricsDir.
+func (c *Client) MetricsList(ctx context.Context, server string) ([]string, error) {
+    return c.MetricsListIn(ctx, server, c.MetricsDir)
+}
+
+// MetricsListIn is like MetricsList but lists the metrics under dir
+// instead of MetricsDir.
+func (c *Client) MetricsListIn(ctx context.Context, server, dir string) ([]string, error) {
+    prefix := c.BaseDir + "." + server
+    if c.FullServerPaths {
+        prefix = server
+    }
+    url := c.findURL(fmt.Sprintf("%s.%s.*", prefix, dir))
+
+    body, err := c.get(ctx, url)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch metrics list: %w", err)
+    }
+
+    metrics, err := parseFindResponse(body)
+    if err != nil {
+        return nil, err
+    }
+
+    var metricNames []string
+    for _, metric := range metrics {
+        if !c.wantMetric(metric) {
+            continue
+        }
+        metricNames = append(metricNames, metric)
+    }
+
+    return metricNames, nil
+}
+
+// Data fetches metric over [From, Until] from /render and parses the
+// response according to RenderFormat.
+func (c *Client) Data(ctx context.Context, metric string) ([]DataPoint, error) {
+    return c.DataIn(ctx, metric, c.From, c.Until)
+}
+
+// DataIn is like Data over [from, until] instead of [From, Until].
+func (c *Client) DataIn(ctx context.Context, metric, from, until string) ([]DataPoint, error) {
+    windows, err := c.windows(from, until)
+    if err != nil {
+        return nil, err
+    }
+
+    var chunks [][]DataPoint
+    for _, window := range windows {
+        dataPoints, err := c.dataBetween(ctx, metric, window[0], window[1])
+        if err != nil {
+            return nil, err
+        }
+        chunks = append(chunks, dataPoints)
+    }
+    if len(chunks) == 1 {
+        return chunks[0], nil
+    }
+
+    return mergeChunks(chunks), nil
+}
+
+// DataBatch is like Data for several metrics at once, fetched with a
+// single POST to /render per time window. Series are matched back to
+// their metric by their "name" tag, then by target, and failing both by
+// position when there is one series per metric, since a TargetTemplate
+// may rename them; metrics without any series are missing from the
+// result.
+func (c *Client) DataBatch(ctx context.Context, metrics []string) (map[string][]DataPoint, error) {
+    return c.DataBatchIn(ctx, metrics, c.From, c.Until)
+}
+
+// DataBatchIn is like DataBatch over [from, until] instead of [From, Until].
+func (c *Client) DataBatchIn(ctx context.Context, metrics []string, from, until string) (map[string][]DataPoint, error) {
+    windows, err := c.windows(from, until)
+    if err != nil {
+        return nil, err
+    }
+
+    chunks := map[string][][]DataPoint{}
+    for _, window := range windows {
+        batch, err := c.batchBetween(ctx, metrics, window[0], window[1])
+        if err != nil {
+            return nil, err
+        }
+        for metric, dataPoints := range batch {
+            chunks[metric] = append(chunks[metric], dataPoints)
+        }
+    }
+
+    result := make(map[string][]DataPoint, len(chunks))
+    for metric, metricChunks := range chunks {
+        if len(metricChunks) == 1 {
+            result[metric] = metricChunks[0]
+            continue
+        }
+        result[metric] = mergeChunks(metricChunks)
+    }
+
+    return result, nil
+}
+
+// windows returns the [from, until] pairs to request: [from, until] itself,
+// or its ChunkSize pieces as Unix timestamps when chunking.
+func (c *Client) windows(from, until string) ([][2]string, error) {
+    if c.ChunkSize <= 0 {
+        return [][2]string{{from, until}}, nil
+    }
+
+    now := time.Now()
+    start, err := ResolveTime(from, now)
+    var end time.Time
+    if err == nil {
+        end, err = ResolveTime(until, now)
+    }
+    if errors.Is(err, ErrUnknownTime) {
+        c.logger().Debug("not chunking a time range only Graphite can resolve", "from", from, "until", until)
+        return [][2]string{{from, until}}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var windows [][2]string
+    for _, chunk := range chunkRange(start, end, c.ChunkSize) {
+        windows = append(windows, [2]string{
+            strconv.FormatInt(chunk[0].Unix(), 10),
+            strconv.FormatInt(chunk[1].Unix(), 10),
+        })
+    }
+
+    return windows, nil
+}
+
+// parser returns the Parser for RenderFormat.
+func (c *Client) parser() (Parser, error) {
+    if c.RenderFormat == RenderFormatJSON {
+        return JSONParser{Validate: c.ValidateSchema}, nil
+    }
+
+    return ParserFor(c.RenderFormat)
+}
+
+func (c *Client) dataBetween(ctx context.Context, metric, from, until string) ([]DataPoint, error) {
+    parser, err := c.parser()
+    if err != nil {
+        return nil, err
+    }
+
+    url := c.renderURL(metric, from, until)
+    if c.DryRun != nil {
+        fmt.Fprintln(c.DryRun, url)
+        return nil, nil
+    }
+
+    if c.Cache != nil {
+        if body, ok := c.Cache.Get(url); ok {
+            c.logger().Debug("cache hit", "url", url)
+            return parser.Parse(body)
+        }
+    }
+
+    body, err := c.get(ctx, url)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch data: %w", err)
+    }
+
+    dataPoints, err := parser.Parse(body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse data for %s: %w", metric, err)
+    }
+    c.checkNoNullPoints(dataPoints)
+
+    if c.Cache != nil {
+        if err := c.Cache.Put(url, body); err != nil {
+            c.logger().Warn("failed to write cache entry", "url", url, "error", err)
+        }
+    }
+
+    return dataPoints, nil
+}
+
+func (c *Client) batchBetween(ctx context.Context, metrics []string, from, until string) (map[string][]DataPoint, error) {
+    parser, err := c.parser()
+    if err != nil {
+        return nil, err
+    }
+
+    url := c.BaseURL + "/render"
+    form := c.renderForm(metrics, from, until)
+    // The cache is keyed by the equivalent GET URL.
+    key := url + "?" + form.Encode()
+    if c.DryRun != nil {
+        fmt.Fprintln(c.DryRun, "POST "+key)
+        return nil, nil
+    }
+
+    var body []byte
+    var cached bool
+    if c.Cache != nil {
+        if body, cached = c.Cache.Get(key); cached {
+            c.logger().Debug("cache hit", "url", key)
+        }
+    }
+    if !cached {
+        body, err = c.post(ctx, url, form)
+        if err != nil {
+            return nil, fmt.Errorf("failed to fetch data: %w", err)
+        }
+    }
+
+    dataPoints, err := parser.Parse(body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse data for %d metrics starting with %s: %w", len(metrics), metrics[0], err)
+    }
+    c.checkNoNullPoints(dataPoints)
+
+    if c.Cache != nil && !cached {
+        if err := c.Cache.Put(key, body); err != nil {
+            c.logger().Warn("failed to write cache entry", "url", key, "error", err)
+        }
+    }
+
+    targets := make(map[string]string, 2*len(metrics))
+    for _, metric := range metrics {
+        targets[metric] = metric
+        targets[c.renderTarget(metric)] = metric
+    }
+
+    batch := map[string][]DataPoint{}
+    for i, dp := range dataPoints {
+        metric, ok := targets[dp.Tags["name"]]
+        if !ok {
+            metric, ok = targets[dp.Target]
+        }
+        if !ok && len(dataPoints) == len(metrics) {
+            // Graphite returns the series in the order of their targets.
+            metric, ok = metrics[i], true
+        }
+        if !ok {
+            c.logger().Debug("ignoring series not matching any requested metric", "target", dp.Target)
+            continue
+        }
+        batch[metric] = append(batch[metric], dp)
+    }
+
+    return batch, nil
+}
+
+// FindSeries returns the tagged series matching every expression via
+// /tags/findSeries, filtered by Include, Exclude and Allowlist.
+func (c *Client) FindSeries(ctx context.Context, exprs []string) ([]string, error) {
+    query := url.Values{"expr": exprs}
+    url := fmt.Sprintf("%s/tags/findSeries?%s", c.BaseURL, query.Encode())
+
+    body, err := c.get(ctx, url)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch series list: %w", err)
+    }
+
+    var series []string
+    err = json.Unmarshal(body, &series)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse JSON: %v", err)
+    }
+
+    var seriesNames []string
+    for _, s := range series {
+        if c.wantMetric(s) {
+            seriesNames = append(seriesNames, s)
+        }
+    }
+
+    return seriesNames, nil
+}
+
+// ParseTaggedSeries splits a tagged series such as "cpu.usage;host=s1"
+// into its name and tags.
+func ParseTaggedSeries(series string) (string, map[string]string) {
+    parts := strings.Split(series, ";")
+    tags := make(map[string]string, len(parts)-1)
+    for _, part := range parts[1:] {
+        if k, v, ok := strings.Cut(part, "="); ok {
+            tags[k] = v
+        }
+    }
+
+    return parts[0], tags
+}
+
+func (c *Client) wantMetric(path string) bool {
+    if c.Allowlist != nil && !c.Allowlist[path] {
+        return false
+    }
+    if c.Exclude != nil && c.Exclude.MatchString(path) {
+        return false
+    }
+    if c.Include != nil && !c.Include.MatchString(path) {
+        return false
+    }
+
+    return true
+}
+
+func (c *Client) findURL(query string) string {
+    return fmt.Sprintf("%s/metrics/find?query=%s&format=%s", c.BaseURL, query, url.QueryEscape(c.FindFormat))
+}
+
+// findNode is an entry of a /metrics/find response. graphite-web's json
+// and treejson formats name the full path "path" or "id"; the completer
+// format uses "path" with a trailing dot on branches.
+type findNode struct {
+    Path string `json:"path"`
+    ID   string `json:"id"`
+}
+
+// parseFindResponse extracts the node paths from a /metrics/find response
+// shaped either as an array of nodes or as {"metrics": [...]}, where the
+// entries may also be bare path strings.
+func parseFindResponse(body []byte) ([]string, error) {
+    var entries []json.RawMessage
+    if err := json.Unmarshal(body, &entries); err != nil {
+        var wrapped struct {
+            Metrics []json.RawMessage `json:"metrics"`
+        }
+        if err := json.Unmarshal(body, &wrapped); err != nil {
+            return nil, fmt.Errorf("failed to parse JSON: %v", err)
+        }
+        entries = wrapped.Metrics
+    }
+
+    var paths []string
+    for _, entry := range entries {
+        var path string
+        if err := json.Unmarshal(entry, &path); err != nil {
+            var node findNode
+            if err := json.Unmarshal(entry, &node); err != nil {
+                return nil, fmt.Errorf("failed to parse JSON: %v", err)
+            }
+            path = node.Path
+            if path == "" {
+                path = node.ID
+            }
+        }
+        if path = strings.TrimSuffix(path, "."); path != "" {
+            paths = append(paths, path)
+        }
+    }
+
+    return paths, nil
+}
+
+// renderTarget is the /render target expression for metric.
+func (c *Client) renderTarget(metric string) string {
+    target := metric
+    if c.TargetTemplate != "" {
+        target = strings.Replace(c.TargetTemplate, "%s", metric, 1)
+    }
+    if c.ConsolidateBy != "" {
+        target = fmt.Sprintf("consolidateBy(%s,'%s')", target, c.ConsolidateBy)
+    }
+
+    return target
+}
+
+// renderForm is the POST form for a /render request covering metrics.
+func (c *Client) renderForm(metrics []string, from, until string) url.Values {
+    form := url.Values{}
+    for _, metric := range metrics {
+        form.Add("target", c.renderTarget(metric))
+    }
+    form.Set("from", from)
+    form.Set("until", until)
+    form.Set("format", c.RenderFormat)
+    if c.MaxDataPoints > 0 {
+        form.Set("maxDataPoints", strconv.Itoa(c.MaxDataPoints))
+    }
+    if c.NoNullPoints {
+        form.Set("noNullPoints", "true")
+    }
+
+    return form
+}
+
+func (c *Client) renderURL(metric, from, until string) string {
+    target := c.renderTarget(metric)
+
+    u := fmt.Sprintf("%s/render?target=%s&from=%s&until=%s&format=%s", c.BaseURL, url.QueryEscape(target), url.QueryEscape(from), url.QueryEscape(until), c.RenderFormat)
+    if c.MaxDataPoints > 0 {
+        u += fmt.Sprintf("&maxDataPoints=%d", c.MaxDataPoints)
+    }
+    if c.NoNullPoints {
+        u += "&noNullPoints=true"
+    }
+
+    return u
+}
+
+// checkNoNullPoints warns, once per Client, when a response requested with
+// NoNullPoints still contains null values.
+func (c *Client) checkNoNullPoints(dataPoints []DataPoint) {
+    if !c.NoNullPoints {
+        return
+    }
+
+    for _, dp := range dataPoints {
+        for _, point := range dp.DataPoints {
+            if len(point) > 0 && point[0] == nil {
+                c.nullPointsNoted.Do(func() {
+                    c.logger().Warn("Graphite ignored noNullPoints, null datapoints are still returned", "target", dp.Target)
+                })
+                return
+            }
+        }
+    }
+}
+
+func (c *Client) get(ctx context.Context, url string) ([]byte, error) {
+    return c.send(ctx, url, nil)
+}
+
+// post is like get but sends form as the body of a POST request.
+func (c *Client) post(ctx context.Context, url string, form url.Values) ([]byte, error) {
+    return c.send(ctx, url, form)
+}
+
+// send makes a GET request, or a POST of form when it is not nil,
+// retrying transient failures.
+func (c *Client) send(ctx context.Context, url string, form url.Values) ([]byte, error) {
+    var lastErr error
+
+    for attempt := 0; attempt <= c.Retries; attempt++ {
+        if attempt > 0 {
+            delay := backoff(attempt)
+            var throttled *throttledError
+            if errors.As(lastErr, &throttled) && throttled.retryAfter > 0 {
+                delay = throttled.retryAfter
+            }
+
+            c.retries.Add(1)
+            c.logger().Debug("retrying", "url", url, "attempt", attempt+1, "delay", delay, "error", lastErr)
+
+            select {
+            case <-time.After(delay):
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            }
+        }
+
+        c.logger().Debug("fetching", "url", url, "attempt", attempt+1)
+
+        body, retryable, err := c.sendFailover(ctx, url, form)
+        if err == nil {
+            return body, nil
+        }
+        if !retryable || ctx.Err() != nil {
+            return nil, err
+        }
+        lastErr = err
+    }
+
+    return nil, lastErr
+}
+
+// sendFailover makes one attempt at url against BaseURL and then each of
+// Fallbacks, stopping at the first response that is not retryable. A 429
+// is returned as is: the backend is up and asked us to slow down.
+func (c *Client) sendFailover(ctx context.Context, url string, form url.Values) ([]byte, bool, error) {
+    body, retryable, err := c.sendOnce(ctx, url, form)
+    if err == nil {
+        c.logger().Debug("fetched", "backend", c.BaseURL)
+    }
+    var throttled *throttledError
+    if !retryable || len(c.Fallbacks) == 0 || errors.As(err, &throttled) {
+        return body, retryable, err
+    }
+
+    path := strings.TrimPrefix(url, c.BaseURL)
+    for _, backend := range c.Fallbacks {
+        if ctx.Err() != nil {
+            break
+        }
+        c.logger().Debug("failing over", "backend", backend, "error", err)
+
+        body, retryable, err = c.sendOnce(ctx, backend+path, form)
+        if err == nil {
+            c.logger().Debug("fetched", "backend", backend)
+        }
+        if !retryable || errors.As(err, &throttled) {
+            break
+        }
+    }
+
+    return body, retryable, err
+}
+
+func (c *Client) sendOnce(ctx context.Context, url string, form url.Values) ([]byte, bool, error) {
+    method := http.MethodGet
+    var reqBody io.Reader
+    if form != nil {
+        method = http.MethodPost
+        reqBody = strings.NewReader(form.Encode())
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to build request: %v", err)
+    }
+    if form != nil {
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+    if c.UserAgent != "" {
+        req.Header.Set("User-Agent", c.UserAgent)
+    }
+    for key, values := range c.Header {
+        req.Header[key] = values
+    }
+    c.authorize(req)
+    // Setting Accept-Encoding ourselves turns off the transport's own
+    // decompression, so responses are decoded explicitly below whatever
+    // client is in use.
+    req.Header.Set("Accept-Encoding", "gzip")
+
+    if err := c.waitRate(ctx); err != nil {
+        return nil, false, err
+    }
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return nil, true, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusTooManyRequests {
+        return nil, true, &throttledError{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+    }
+    if location := resp.Header.Get("Location"); location != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+        return nil, false, fmt.Errorf("unexpected status code: %d (redirect to %s)", resp.StatusCode, location)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, resp.StatusCode >= 500, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+    }
+
+    var reader io.Reader = resp.Body
+    if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+        gz, err := gzip.NewReader(resp.Body)
+        if err != nil {
+            return nil, true, fmt.Errorf("failed to decompress response body: %w", err)
+        }
+        defer gz.Close()
+        reader = gz
+    }
+
+    body, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, true, fmt.Errorf("failed to read response body: %w", err)
+    }
+
+    return body, false, nil
+}
+
+// throttledError is a 429 response. retryAfter is the wait requested by
+// its Retry-After header, or 0 when there was none.
+type throttledError struct {
+    retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+    if e.retryAfter > 0 {
+        return fmt.Sprintf("unexpected status code: %d (retry after %s)", http.StatusTooManyRequests, e.retryAfter)
+    }
+
+    return fmt.Sprintf("unexpected status code: %d", http.StatusTooManyRequests)
+}
+
+// parseRetryAfter reads a Retry-After value given either in seconds or as
+// an HTTP date, capped at maxRetryAfter. It returns 0 when the value is
+// missing, malformed or already in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+    if value == "" {
+        return 0
+    }
+
+    var delay time.Duration
+    if seconds, err := strconv.Atoi(value); err == nil {
+        if seconds > int(maxRetryAfter/time.Second) {
+            return maxRetryAfter
+        }
+        delay = time.Duration(seconds) * time.Second
+    } else if at, err := http.ParseTime(value); err == nil {
+        delay = at.Sub(now)
+    }
+
+    if delay <= 0 {
+        return 0
+    }
+    if delay > maxRetryAfter {
+        return maxRetryAfter
+    }
+
+    return delay
+}
+
+// RetryCount returns the number of retries made so far, across every
+// request of the client.
+func (c *Client) RetryCount() int64 {
+    return c.retries.Load()
+}
+
+func (c *Client) logger() *slog.Logger {
+    if c.Logger == nil {
+        return slog.Default()
+    }
+
+    return c.Logger
+}
+
+func (c *Client) authorize(req *http.Request) {
+    if c.Token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.Token)
+        return
+    }
+    if c.Username != "" || c.Password != "" {
+        req.SetBasicAuth(c.Username, c.Password)
+    }
+}
+
+// waitRate blocks until the next request may be sent under Rate. A
+// request given up on while waiting hands its slot back, unless a later
+// request has already been scheduled after it.
+func (c *Client) waitRate(ctx context.Context) error {
+    if c.Rate <= 0 {
+        return nil
+    }
+    interval := time.Duration(float64(time.Second) / c.Rate)
+
+    c.rateMu.Lock()
+    now := time.Now()
+    if c.nextRequest.Before(now) {
+        c.nextRequest = now
+    }
+    slot := c.nextRequest
+    c.nextRequest = slot.Add(interval)
+    c.rateMu.Unlock()
+
+    delay := slot.Sub(now)
+    if delay <= 0 {
+        return nil
+    }
+
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        c.rateMu.Lock()
+        if c.nextRequest.Equal(slot.Add(interval)) {
+            c.nextRequest = slot
+        }
+        c.rateMu.Unlock()
+        return ctx.Err()
+    }
+}
+
+func backoff(attempt int) time.Duration {
+    delay := retryBaseDelay << (attempt - 1)
+    if delay <= 0 || delay > retryMaxDelay {
+        delay = retryMaxDelay
+    }
+
+    return delay/2 + rand.N(delay/2)
+}
@@ -0,0 +1,680 @@
+package graphite
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "regexp"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDataCancelled(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-r.Context().Done()
+    }))
+    defer srv.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(20*time.Millisecond, cancel)
+
+    client := NewClient(srv.URL, srv.Client())
+    _, err := client.Data(ctx, "cpu")
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Data error = %v, want context.Canceled", err)
+    }
+}
+
+func TestServerListCancelled(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    client := NewClient("http://graphite.invalid", nil)
+    _, err := client.ServerList(ctx)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("ServerList error = %v, want context.Canceled", err)
+    }
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+    tests := []struct {
+        name     string
+        statuses []int
+        retries  int
+        wantErr  bool
+    }{
+        {"recovers", []int{503, 503, 200}, 3, false},
+        {"gives up", []int{503, 503, 200}, 1, true},
+        {"client error is not retried", []int{404, 200}, 3, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var calls atomic.Int64
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                n := int(calls.Add(1)) - 1
+                if status := tt.statuses[min(n, len(tt.statuses)-1)]; status != http.StatusOK {
+                    w.WriteHeader(status)
+                    return
+                }
+                fmt.Fprint(w, `[{"target": "cpu", "datapoints": [[1, 100]]}]`)
+            }))
+            defer srv.Close()
+
+            client := NewClient(srv.URL, srv.Client())
+            client.Retries = tt.retries
+            dataPoints, err := client.Data(context.Background(), "cpu")
+
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Data error = %v, want error %t", err, tt.wantErr)
+            }
+            if !tt.wantErr && len(dataPoints) != 1 {
+                t.Errorf("got %d series, want 1", len(dataPoints))
+            }
+        })
+    }
+}
+
+func TestBackoff(t *testing.T) {
+    for attempt := 1; attempt <= 8; attempt++ {
+        want := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+        if got := backoff(attempt); got < want/2 || got >= want {
+            t.Errorf("backoff(%d) = %s, want in [%s, %s)", attempt, got, want/2, want)
+        }
+    }
+}
+
+func TestBasicAuth(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "s3cret" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        fmt.Fprint(w, `[{"path": "base.s1"}]`)
+    }))
+    defer srv.Close()
+
+    tests := []struct {
+        name     string
+        username string
+        password string
+        wantErr  string
+    }{
+        {"credentials", "alice", "s3cret", ""},
+        {"wrong password", "alice", "guess", "unexpected status code: 401"},
+        {"none", "", "", "unexpected status code: 401"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := NewClient(srv.URL, srv.Client())
+            client.BaseDir = "base"
+            client.Username = tt.username
+            client.Password = tt.password
+
+            servers, err := client.ServerList(context.Background())
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("ServerList error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil || len(servers) != 1 || servers[0] != "s1" {
+                t.Errorf("ServerList = %q, %v, want [s1]", servers, err)
+            }
+        })
+    }
+}
+
+func TestBearerToken(t *testing.T) {
+    var got string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r.Header.Get("Authorization")
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    client := NewClient(srv.URL, srv.Client())
+    client.Token = "abc123"
+    if _, err := client.ServerList(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if got != "Bearer abc123" {
+        t.Errorf("Authorization = %q, want %q", got, "Bearer abc123")
+    }
+}
+
+// findServer answers every /metrics/find request with paths.
+func findServer(t *testing.T, paths ...string) *httptest.Server {
+    t.Helper()
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var nodes []string
+        for _, path := range paths {
+            nodes = append(nodes, fmt.Sprintf(`{"path": %q}`, path))
+        }
+        fmt.Fprintf(w, "[%s]", strings.Join(nodes, ","))
+    }))
+    t.Cleanup(srv.Close)
+
+    return srv
+}
+
+func TestMetricFilters(t *testing.T) {
+    srv := findServer(t, "b.s1.snmp.cpu_user", "b.s1.snmp.cpu_idle", "b.s1.snmp.mem")
+
+    tests := []struct {
+        name    string
+        include string
+        exclude string
+        want    []string
+    }{
+        {"none", "", "", []string{"b.s1.snmp.cpu_user", "b.s1.snmp.cpu_idle", "b.s1.snmp.mem"}},
+        {"include", "cpu", "", []string{"b.s1.snmp.cpu_user", "b.s1.snmp.cpu_idle"}},
+        {"exclude", "", "idle$", []string{"b.s1.snmp.cpu_user", "b.s1.snmp.mem"}},
+        {"exclude wins", "cpu", "cpu_", nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := NewClient(srv.URL, srv.Client())
+            if tt.include != "" {
+                client.Include = regexp.MustCompile(tt.include)
+            }
+            if tt.exclude != "" {
+                client.Exclude = regexp.MustCompile(tt.exclude)
+            }
+
+            got, err := client.MetricsList(context.Background(), "s1")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("MetricsList = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRenderURLConsolidation(t *testing.T) {
+    tests := []struct {
+        name          string
+        maxDataPoints int
+        consolidateBy string
+        want          string
+    }{
+        {"neither", 0, "", "http://g/render?target=cpu&from=-7d&until=now&format=json"},
+        {"maxDataPoints", 500, "", "http://g/render?target=cpu&from=-7d&until=now&format=json&maxDataPoints=500"},
+        {"consolidateBy", 0, "max", "http://g/render?target=consolidateBy%28cpu%2C%27max%27%29&from=-7d&until=now&format=json"},
+        {"both", 100, "sum", "http://g/render?target=consolidateBy%28cpu%2C%27sum%27%29&from=-7d&until=now&format=json&maxDataPoints=100"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := NewClient("http://g", nil)
+            client.MaxDataPoints = tt.maxDataPoints
+            client.ConsolidateBy = tt.consolidateBy
+
+            if got := client.renderURL("cpu", client.From, client.Until); got != tt.want {
+                t.Errorf("renderURL = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestFindSeries(t *testing.T) {
+    var query string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query = r.URL.RequestURI()
+        fmt.Fprint(w, `["cpu;host=s1", "cpu;host=s2", "mem;host=s1"]`)
+    }))
+    defer srv.Close()
+
+    client := NewClient(srv.URL, srv.Client())
+    client.Exclude = regexp.MustCompile(`^mem`)
+
+    series, err := client.FindSeries(context.Background(), []string{"name=~cpu|mem", "host!="})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "/tags/findSeries?expr=name%3D~cpu%7Cmem&expr=host%21%3D"; query != want {
+        t.Errorf("request = %s, want %s", query, want)
+    }
+    if want := []string{"cpu;host=s1", "cpu;host=s2"}; !reflect.DeepEqual(series, want) {
+        t.Errorf("FindSeries = %q, want %q", series, want)
+    }
+}
+
+// renderServer answers every request with body.
+func renderServer(t *testing.T, body string) *httptest.Server {
+    t.Helper()
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, body)
+    }))
+    t.Cleanup(srv.Close)
+
+    return srv
+}
+
+func TestDataParsesSeries(t *testing.T) {
+    srv := renderServer(t, `[{"target": "cpu", "datapoints": [[1.5, 100], [null, 200]]}]`)
+
+    dataPoints, err := NewClient(srv.URL, srv.Client()).Data(context.Background(), "cpu")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(dataPoints) != 1 || dataPoints[0].Target != "cpu" || len(dataPoints[0].DataPoints) != 2 {
+        t.Fatalf("Data = %+v, want cpu with two datapoints", dataPoints)
+    }
+    points := dataPoints[0].DataPoints
+    if *points[0][0] != 1.5 || *points[0][1] != 100 || points[1][0] != nil || *points[1][1] != 200 {
+        t.Errorf("datapoints = [%v %v] [%v %v], want [1.5 100] [null 200]", *points[0][0], *points[0][1], points[1][0], *points[1][1])
+    }
+}
+
+func TestDataParseError(t *testing.T) {
+    srv := renderServer(t, `<html>not json</html>`)
+
+    _, err := NewClient(srv.URL, srv.Client()).Data(context.Background(), "cpu")
+    if err == nil || !strings.Contains(err.Error(), "failed to parse data for cpu") {
+        t.Errorf("Data error = %v, want a parse error naming cpu", err)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    var calls atomic.Int64
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if calls.Add(1) == 1 {
+            w.Header().Set("Retry-After", "1")
+            w.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    client := NewClient(srv.URL, srv.Client())
+    start := time.Now()
+    if _, err := client.ServerList(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+
+    if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+        t.Errorf("retry after a 429 with Retry-After: 1 took %s, want about 1s", elapsed)
+    }
+    if n := client.RetryCount(); n != 1 {
+        t.Errorf("RetryCount = %d, want 1", n)
+    }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        value string
+        want  time.Duration
+    }{
+        {"", 0},
+        {"3", 3 * time.Second},
+        {"0", 0},
+        {"-1", 0},
+        {"3600", maxRetryAfter},
+        {"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+        {"Wed, 01 May 2024 11:00:00 GMT", 0},
+        {"soon", 0},
+    }
+
+    for _, tt := range tests {
+        if got := parseRetryAfter(tt.value, now); got != tt.want {
+            t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestGzipResponse(t *testing.T) {
+    var acceptEncoding string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        acceptEncoding = r.Header.Get("Accept-Encoding")
+        w.Header().Set("Content-Encoding", "gzip")
+        gz := gzip.NewWriter(w)
+        fmt.Fprint(gz, `[{"target": "cpu", "datapoints": [[4, 100]]}]`)
+        gz.Close()
+    }))
+    defer srv.Close()
+
+    dataPoints, err := NewClient(srv.URL, srv.Client()).Data(context.Background(), "cpu")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if acceptEncoding != "gzip" {
+        t.Errorf("Accept-Encoding = %q, want gzip", acceptEncoding)
+    }
+    if len(dataPoints) != 1 || *dataPoints[0].DataPoints[0][0] != 4 {
+        t.Errorf("Data = %+v, want the decompressed series", dataPoints)
+    }
+}
+
+func TestGzipResponseCorrupt(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Encoding", "gzip")
+        fmt.Fprint(w, "not gzip")
+    }))
+    defer srv.Close()
+
+    client := NewClient(srv.URL, srv.Client())
+    client.Retries = 0
+    if _, err := client.Data(context.Background(), "cpu"); err == nil || !strings.Contains(err.Error(), "decompress") {
+        t.Errorf("Data error = %v, want a decompression error", err)
+    }
+}
+
+func TestFailover(t *testing.T) {
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer down.Close()
+    refused := httptest.NewServer(http.NotFoundHandler())
+    refused.Close()
+    standby := findServer(t, "base.s1")
+
+    tests := []struct {
+        name      string
+        primary   string
+        fallbacks []string
+    }{
+        {"5xx", down.URL, []string{standby.URL}},
+        {"connection refused", refused.URL, []string{standby.URL}},
+        {"second standby", down.URL, []string{refused.URL, standby.URL}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := NewClient(tt.primary, nil)
+            client.Fallbacks = tt.fallbacks
+            client.BaseDir = "base"
+            client.Retries = 0
+
+            servers, err := client.ServerList(context.Background())
+            if err != nil || len(servers) != 1 || servers[0] != "s1" {
+                t.Errorf("ServerList = %q, %v, want [s1] from the standby", servers, err)
+            }
+        })
+    }
+}
+
+func TestNoFailoverOnClientError(t *testing.T) {
+    var standbyCalls atomic.Int64
+    missing := httptest.NewServer(http.NotFoundHandler())
+    defer missing.Close()
+    standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        standbyCalls.Add(1)
+        fmt.Fprint(w, `[]`)
+    }))
+    defer standby.Close()
+
+    client := NewClient(missing.URL, nil)
+    client.Fallbacks = []string{standby.URL}
+    if _, err := client.ServerList(context.Background()); err == nil {
+        t.Error("ServerList succeeded after a 404")
+    }
+    if n := standbyCalls.Load(); n != 0 {
+        t.Errorf("standby received %d requests after a 404, want none", n)
+    }
+}
+
+func TestErrorShapedResponse(t *testing.T) {
+    tests := []struct {
+        body string
+        want string
+    }{
+        {`{"error": "query timed out"}`, "failed to parse data for cpu: Graphite returned an error: query timed out"},
+        {`{"errors": {"target": "invalid"}}`, `failed to parse data for cpu: Graphite returned an error: {"target": "invalid"}`},
+        {`{"status": "ok"}`, "failed to parse data for cpu: failed to parse JSON: got an object instead of an array of series"},
+    }
+
+    for _, tt := range tests {
+        srv := renderServer(t, tt.body)
+        _, err := NewClient(srv.URL, srv.Client()).Data(context.Background(), "cpu")
+        if err == nil || err.Error() != tt.want {
+            t.Errorf("Data of %s: error = %v, want %q", tt.body, err, tt.want)
+        }
+    }
+}
+
+func TestFindResponseShapes(t *testing.T) {
+    tests := []struct {
+        name   string
+        format string
+        body   string
+    }{
+        {"node list", "json", `[{"path": "b.s1", "leaf": 0}, {"path": "b.s2", "leaf": 0}]`},
+        {"treejson ids", "treejson", `[{"id": "b.s1", "text": "s1"}, {"id": "b.s2", "text": "s2"}]`},
+        {"completer", "completer", `{"metrics": [{"path": "b.s1.", "name": "s1"}, {"path": "b.s2.", "name": "s2"}]}`},
+        {"metrics strings", "json", `{"metrics": ["b.s1", "b.s2"]}`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var format string
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                format = r.URL.Query().Get("format")
+                fmt.Fprint(w, tt.body)
+            }))
+            defer srv.Close()
+
+            client := NewClient(srv.URL, srv.Client())
+            client.BaseDir = "b"
+            client.FindFormat = tt.format
+            servers, err := client.ServerList(context.Background())
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if format != tt.format {
+                t.Errorf("format = %q, want %q", format, tt.format)
+            }
+            if want := []string{"s1", "s2"}; !reflect.DeepEqual(servers, want) {
+                t.Errorf("servers = %q, want %q", servers, want)
+            }
+        })
+    }
+}
+
+func TestParseFindResponseInvalid(t *testing.T) {
+    for _, body := range []string{`not json`, `[1, 2]`, `{"metrics": [true]}`} {
+        if paths, err := parseFindResponse([]byte(body)); err == nil {
+            t.Errorf("parseFindResponse(%s) = %q, want an error", body, paths)
+        }
+    }
+}
+
+func TestTargetTemplate(t *testing.T) {
+    tests := []struct {
+        name          string
+        template      string
+        consolidateBy string
+        want          string
+    }{
+        {"bare", "", "", "target=cpu&"},
+        {"summarize", `summarize(%s,"1h","max")`, "", "target=summarize%28cpu%2C%221h%22%2C%22max%22%29&"},
+        {"alias with spaces", "alias(%s,'a b')", "", "target=alias%28cpu%2C%27a+b%27%29&"},
+        {"with consolidateBy", "scale(%s,8)", "max", "target=consolidateBy%28scale%28cpu%2C8%29%2C%27max%27%29&"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var target string
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                target = r.URL.Query().Get("target")
+                fmt.Fprintf(w, `[{"target": %q, "datapoints": [[1, 100]]}]`, target)
+            }))
+            defer srv.Close()
+
+            client := NewClient(srv.URL, srv.Client())
+            client.TargetTemplate = tt.template
+            client.ConsolidateBy = tt.consolidateBy
+
+            if got := client.renderURL("cpu", client.From, client.Until); !strings.Contains(got, "?"+tt.want) {
+                t.Errorf("renderURL = %s, want it to contain %s", got, tt.want)
+            }
+            dataPoints, err := client.Data(context.Background(), "cpu")
+            if err != nil {
+                t.Fatal(err)
+            }
+            if want := client.renderTarget("cpu"); target != want || len(dataPoints) != 1 {
+                t.Errorf("server got target %q and returned %d series, want %q and 1", target, len(dataPoints), want)
+            }
+        })
+    }
+}
+
+func TestNoNullPoints(t *testing.T) {
+    tests := []struct {
+        name        string
+        noNull      bool
+        body        string
+        wantParam   bool
+        wantWarning bool
+    }{
+        {"off", false, `[{"target": "cpu", "datapoints": [[1, 100], [null, 200]]}]`, false, false},
+        {"honored", true, `[{"target": "cpu", "datapoints": [[1, 100]]}]`, true, false},
+        {"ignored", true, `[{"target": "cpu", "datapoints": [[1, 100], [null, 200]]}]`, true, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var queries []string
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                queries = append(queries, r.URL.RawQuery)
+                fmt.Fprint(w, tt.body)
+            }))
+            defer srv.Close()
+
+            var logs bytes.Buffer
+            client := NewClient(srv.URL, srv.Client())
+            client.NoNullPoints = tt.noNull
+            client.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+            for range 2 {
+                if _, err := client.Data(context.Background(), "cpu"); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            for _, query := range queries {
+                if got := strings.Contains(query, "&noNullPoints=true"); got != tt.wantParam {
+                    t.Errorf("query %s: noNullPoints present %t, want %t", query, got, tt.wantParam)
+                }
+            }
+            warnings := strings.Count(logs.String(), "Graphite ignored noNullPoints")
+            if want := map[bool]int{false: 0, true: 1}[tt.wantWarning]; warnings != want {
+                t.Errorf("got %d warnings over 2 requests, want %d:\n%s", warnings, want, logs.String())
+            }
+        })
+    }
+}
+
+func TestRateWaitIsNotTimed(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    httpClient := srv.Client()
+    httpClient.Timeout = 50 * time.Millisecond
+    client := NewClient(srv.URL, httpClient)
+    client.Rate = 10
+    client.Retries = 0
+
+    // From the second request on, each waits 100ms for its slot, longer
+    // than the request timeout.
+    for i := 0; i < 3; i++ {
+        if _, err := client.ServerList(context.Background()); err != nil {
+            t.Fatalf("request %d: %v", i+1, err)
+        }
+    }
+}
+
+func TestRateCancelReleasesSlot(t *testing.T) {
+    client := NewClient("http://graphite.invalid", nil)
+    client.Rate = 10
+
+    if err := client.waitRate(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if err := client.waitRate(ctx); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("waitRate error = %v, want context.DeadlineExceeded", err)
+    }
+
+    // The cancelled request gave its slot back, so the next one only
+    // waits out the rest of the first interval.
+    start := time.Now()
+    if err := client.waitRate(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+        t.Errorf("waited %s after a cancelled request, want under 150ms", elapsed)
+    }
+}
+
+func TestDataBatchRenamedTargets(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+        want map[string]float64
+    }{
+        {
+            "by name tag",
+            `[{"target": "b renamed", "tags": {"name": "base.b"}, "datapoints": [[2, 100]]},
+              {"target": "a renamed", "tags": {"name": "base.a"}, "datapoints": [[1, 100]]}]`,
+            map[string]float64{"base.a": 1, "base.b": 2},
+        },
+        {
+            "by position",
+            `[{"target": "first", "datapoints": [[1, 100]]}, {"target": "second", "datapoints": [[2, 100]]}]`,
+            map[string]float64{"base.a": 1, "base.b": 2},
+        },
+        {
+            "unmatched series dropped",
+            `[{"target": "first", "datapoints": [[1, 100]]}]`,
+            map[string]float64{},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                fmt.Fprint(w, tt.body)
+            }))
+            defer srv.Close()
+
+            client := NewClient(srv.URL, srv.Client())
+            client.TargetTemplate = `aliasByNode(%s, 1)`
+            batch, err := client.DataBatch(context.Background(), []string{"base.a", "base.b"})
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            got := map[string]float64{}
+            for metric, dataPoints := range batch {
+                if len(dataPoints) != 1 || len(dataPoints[0].DataPoints) != 1 {
+                    t.Fatalf("%s = %v, want one series with one point", metric, dataPoints)
+                }
+                got[metric] = *dataPoints[0].DataPoints[0][0]
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("DataBatch values = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
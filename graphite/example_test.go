@@ -0,0 +1,64 @@
+package graphite_test
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+
+    "graphite/graphite"
+)
+
+func ExampleCalculateStatistics() {
+    one, two, three := 1.0, 2.0, 3.0
+    t1, t2, t3 := 100.0, 200.0, 300.0
+    dataPoints := []graphite.DataPoint{{
+        Target:     "cpu",
+        DataPoints: [][]*float64{{&one, &t1}, {nil, &t2}, {&three, &t3}, {&two, &t3}},
+    }}
+
+    stats, err := graphite.CalculateStatistics(dataPoints, graphite.StatsOptions{Percentiles: []float64{50}})
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    fmt.Println(stats.Count, stats.NullCount, stats.Average, stats.Maximum, stats.Percentiles["p50"])
+    // Output: 3 1 2 3 2
+}
+
+func ExampleClient() {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/metrics/find":
+            fmt.Fprint(w, `[{"path": "servers.web1.snmp.load"}]`)
+        case "/render":
+            fmt.Fprint(w, `[{"target": "servers.web1.snmp.load", "datapoints": [[0.5, 100], [1.5, 160]]}]`)
+        }
+    }))
+    defer srv.Close()
+
+    client := graphite.NewClient(srv.URL, srv.Client())
+    client.BaseDir = "servers"
+    client.From = "-1h"
+
+    ctx := context.Background()
+    metrics, err := client.MetricsList(ctx, "web1")
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    for _, metric := range metrics {
+        dataPoints, err := client.Data(ctx, metric)
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+        stats, err := graphite.CalculateStatistics(dataPoints, graphite.StatsOptions{})
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+        fmt.Printf("%s: average %g over %d datapoints\n", metric, stats.Average, stats.Count)
+    }
+    // Output: servers.web1.snmp.load: average 1 over 2 datapoints
+}
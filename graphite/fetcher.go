@@ -0,0 +1,61 @@
+package graphite
+
+import "context"
+
+// Fetcher is the set of Graphite queries needed to discover and summarize
+// metrics. *Client answers them over HTTP; MemoryFetcher answers them from
+// canned data.
+type Fetcher interface {
+    ServerList(ctx context.Context) ([]string, error)
+    MetricsListIn(ctx context.Context, server, dir string) ([]string, error)
+    FindSeries(ctx context.Context, exprs []string) ([]string, error)
+    DataIn(ctx context.Context, metric, from, until string) ([]DataPoint, error)
+    DataBatchIn(ctx context.Context, metrics []string, from, until string) (map[string][]DataPoint, error)
+    // RetryCount is the number of requests retried so far.
+    RetryCount() int64
+}
+
+var _ Fetcher = (*Client)(nil)
+
+// MemoryFetcher is a Fetcher that serves fixed data without any network
+// access, for exercising code built on Fetcher. Metrics maps a server to
+// its metric paths in every metrics directory, Tagged is returned for any
+// tag query and Series maps a metric path to its series whatever the time
+// range. Unknown metrics have no series.
+type MemoryFetcher struct {
+    Servers []string
+    Metrics map[string][]string
+    Tagged  []string
+    Series  map[string][]DataPoint
+}
+
+func (m *MemoryFetcher) ServerList(ctx context.Context) ([]string, error) {
+    return m.Servers, nil
+}
+
+func (m *MemoryFetcher) MetricsListIn(ctx context.Context, server, dir string) ([]string, error) {
+    return m.Metrics[server], nil
+}
+
+func (m *MemoryFetcher) FindSeries(ctx context.Context, exprs []string) ([]string, error) {
+    return m.Tagged, nil
+}
+
+func (m *MemoryFetcher) DataIn(ctx context.Context, metric, from, until string) ([]DataPoint, error) {
+    return m.Series[metric], nil
+}
+
+func (m *MemoryFetcher) DataBatchIn(ctx context.Context, metrics []string, from, until string) (map[string][]DataPoint, error) {
+    batch := make(map[string][]DataPoint, len(metrics))
+    for _, metric := range metrics {
+        if series, ok := m.Series[metric]; ok {
+            batch[metric] = series
+        }
+    }
+
+    return batch, nil
+}
+
+func (m *MemoryFetcher) RetryCount() int64 {
+    return 0
+}
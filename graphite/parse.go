@@ -0,0 +1,256 @@
+package graphite
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Render formats understood by ParserFor.
+const (
+    RenderFormatJSON = "json"
+    RenderFormatRaw  = "raw"
+    RenderFormatCSV  = "csv"
+)
+
+// Parser decodes a /render response body into its series.
+type Parser interface {
+    Parse(body []byte) ([]DataPoint, error)
+}
+
+// ParserFor returns the Parser for a /render format parameter.
+func ParserFor(format string) (Parser, error) {
+    switch format {
+    case RenderFormatJSON:
+        return JSONParser{}, nil
+    case RenderFormatRaw:
+        return RawParser{}, nil
+    case RenderFormatCSV:
+        return CSVParser{}, nil
+    default:
+        return nil, fmt.Errorf("unsupported render format %q", format)
+    }
+}
+
+// ParseRender decodes body according to format.
+func ParseRender(format string, body []byte) ([]DataPoint, error) {
+    parser, err := ParserFor(format)
+    if err != nil {
+        return nil, err
+    }
+
+    return parser.Parse(body)
+}
+
+// JSONParser parses format=json responses. With Validate, a response that
+// does not strictly have the expected shape is an error rather than being
+// decoded as well as json.Unmarshal manages; see validateSeries.
+type JSONParser struct {
+    Validate bool
+}
+
+func (p JSONParser) Parse(body []byte) ([]DataPoint, error) {
+    var dataPoints []DataPoint
+    if err := json.Unmarshal(body, &dataPoints); err != nil {
+        if msg, ok := errorMessage(body); ok {
+            if msg == "" {
+                return nil, fmt.Errorf("failed to parse JSON: got an object instead of an array of series")
+            }
+            return nil, fmt.Errorf("Graphite returned an error: %s", msg)
+        }
+        return nil, fmt.Errorf("failed to parse JSON: %v", err)
+    }
+    if p.Validate {
+        if err := validateSeries(body); err != nil {
+            return nil, fmt.Errorf("invalid render response: %w", err)
+        }
+    }
+
+    return dataPoints, nil
+}
+
+// validateSeries checks that body is an array of series, each with a
+// non-empty string target and a datapoints array of [value, timestamp]
+// pairs, where the value is a number or null and the timestamp a number.
+// json.Unmarshal accepts a missing target or datapoints, pairs of any
+// length and null timestamps without complaint.
+func validateSeries(body []byte) error {
+    var series []map[string]json.RawMessage
+    if err := json.Unmarshal(body, &series); err != nil {
+        return fmt.Errorf("want an array of series objects: %v", err)
+    }
+
+    for i, s := range series {
+        var target string
+        if raw, ok := s["target"]; !ok || json.Unmarshal(raw, &target) != nil || target == "" {
+            return fmt.Errorf("series %d: want a non-empty string target, got %s", i, rawOrMissing(raw, ok))
+        }
+
+        var points []json.RawMessage
+        if raw, ok := s["datapoints"]; !ok || json.Unmarshal(raw, &points) != nil || points == nil {
+            return fmt.Errorf("series %d (%s): want a datapoints array, got %s", i, target, rawOrMissing(raw, ok))
+        }
+
+        for j, raw := range points {
+            var point []json.RawMessage
+            if json.Unmarshal(raw, &point) != nil || len(point) != 2 {
+                return fmt.Errorf("series %d (%s): datapoint %d: want [value, timestamp], got %s", i, target, j, raw)
+            }
+            if !isJSONNumber(point[0]) && string(point[0]) != "null" {
+                return fmt.Errorf("series %d (%s): datapoint %d: want a number or null value, got %s", i, target, j, point[0])
+            }
+            if !isJSONNumber(point[1]) {
+                return fmt.Errorf("series %d (%s): datapoint %d: want a number timestamp, got %s", i, target, j, point[1])
+            }
+        }
+    }
+
+    return nil
+}
+
+func isJSONNumber(raw json.RawMessage) bool {
+    var v any
+    if err := json.Unmarshal(raw, &v); err != nil {
+        return false
+    }
+    _, ok := v.(float64)
+    return ok
+}
+
+func rawOrMissing(raw json.RawMessage, ok bool) string {
+    if !ok {
+        return "none"
+    }
+
+    return string(raw)
+}
+
+// errorMessage recognizes the error objects some Graphite proxies send
+// with a 200 status instead of a series array. The message is empty when
+// the object does not carry one.
+func errorMessage(body []byte) (string, bool) {
+    var object map[string]json.RawMessage
+    if err := json.Unmarshal(body, &object); err != nil {
+        return "", false
+    }
+
+    for _, field := range []string{"error", "message", "errors", "detail"} {
+        raw, ok := object[field]
+        if !ok {
+            continue
+        }
+        var msg string
+        if err := json.Unmarshal(raw, &msg); err == nil && msg != "" {
+            return msg, true
+        }
+        return string(raw), true
+    }
+
+    return "", true
+}
+
+// RawParser parses format=raw responses, one series per line:
+//
+//	target,start,end,step|value,value,None,...
+type RawParser struct{}
+
+func (RawParser) Parse(body []byte) ([]DataPoint, error) {
+    var dataPoints []DataPoint
+
+    for _, line := range strings.Split(string(body), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+
+        header, values, ok := strings.Cut(line, "|")
+        if !ok {
+            return nil, fmt.Errorf("failed to parse raw series: missing '|' in %q", line)
+        }
+
+        // The target itself may contain commas, so split from the right.
+        fields := strings.Split(header, ",")
+        if len(fields) < 4 {
+            return nil, fmt.Errorf("failed to parse raw series header %q", header)
+        }
+        n := len(fields)
+        target := strings.Join(fields[:n-3], ",")
+        start, err1 := strconv.ParseInt(fields[n-3], 10, 64)
+        step, err2 := strconv.ParseInt(fields[n-1], 10, 64)
+        if err1 != nil || err2 != nil {
+            return nil, fmt.Errorf("failed to parse raw series header %q", header)
+        }
+
+        dp := DataPoint{Target: target}
+        for i, field := range strings.Split(values, ",") {
+            timestamp := float64(start + int64(i)*step)
+            if field == "None" || field == "" {
+                dp.DataPoints = append(dp.DataPoints, []*float64{nil, &timestamp})
+                continue
+            }
+
+            value, err := strconv.ParseFloat(field, 64)
+            if err != nil {
+                return nil, fmt.Errorf("failed to parse raw value %q: %v", field, err)
+            }
+            dp.DataPoints = append(dp.DataPoints, []*float64{&value, &timestamp})
+        }
+        dataPoints = append(dataPoints, dp)
+    }
+
+    return dataPoints, nil
+}
+
+// CSVParser parses format=csv responses, one datapoint per row:
+//
+//	target,2006-01-02 15:04:05,value
+//
+// Timestamps are interpreted as UTC and empty values as nulls.
+type CSVParser struct{}
+
+func (CSVParser) Parse(body []byte) ([]DataPoint, error) {
+    var dataPoints []DataPoint
+    index := map[string]int{}
+
+    r := csv.NewReader(bytes.NewReader(body))
+    r.FieldsPerRecord = 3
+    for {
+        record, err := r.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse CSV: %v", err)
+        }
+
+        ts, err := time.Parse(time.DateTime, record[1])
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse CSV timestamp %q: %v", record[1], err)
+        }
+        timestamp := float64(ts.Unix())
+
+        point := []*float64{nil, &timestamp}
+        if record[2] != "" {
+            value, err := strconv.ParseFloat(record[2], 64)
+            if err != nil {
+                return nil, fmt.Errorf("failed to parse CSV value %q: %v", record[2], err)
+            }
+            point[0] = &value
+        }
+
+        i, ok := index[record[0]]
+        if !ok {
+            i = len(dataPoints)
+            index[record[0]] = i
+            dataPoints = append(dataPoints, DataPoint{Target: record[0]})
+        }
+        dataPoints[i].DataPoints = append(dataPoints[i].DataPoints, point)
+    }
+
+    return dataPoints, nil
+}
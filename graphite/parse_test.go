@@ -0,0 +1,125 @@
+package graphite
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseTags(t *testing.T) {
+    body := []byte(`[
+        {"target": "cpu;host=s1", "tags": {"name": "cpu", "host": "s1"}, "datapoints": [[1, 100]]},
+        {"target": "mem", "datapoints": [[2, 100]]}
+    ]`)
+
+    dataPoints, err := ParseRender(RenderFormatJSON, body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(dataPoints) != 2 {
+        t.Fatalf("got %d series, want 2", len(dataPoints))
+    }
+    if want := map[string]string{"name": "cpu", "host": "s1"}; !reflect.DeepEqual(dataPoints[0].Tags, want) {
+        t.Errorf("tagged series tags = %v, want %v", dataPoints[0].Tags, want)
+    }
+    if dataPoints[1].Tags != nil {
+        t.Errorf("untagged series tags = %v, want none", dataPoints[1].Tags)
+    }
+}
+
+func TestParseTaggedSeries(t *testing.T) {
+    tests := []struct {
+        series   string
+        wantName string
+        wantTags map[string]string
+    }{
+        {"cpu.usage;host=s1;dc=ams", "cpu.usage", map[string]string{"host": "s1", "dc": "ams"}},
+        {"cpu.usage", "cpu.usage", map[string]string{}},
+    }
+
+    for _, tt := range tests {
+        name, tags := ParseTaggedSeries(tt.series)
+        if name != tt.wantName || !reflect.DeepEqual(tags, tt.wantTags) {
+            t.Errorf("ParseTaggedSeries(%q) = %q, %v, want %q, %v", tt.series, name, tags, tt.wantName, tt.wantTags)
+        }
+    }
+}
+
+// values flattens series into [value, timestamp] pairs, with nulls as
+// nil values.
+func values(dp DataPoint) [][2]*float64 {
+    var pairs [][2]*float64
+    for _, point := range dp.DataPoints {
+        pairs = append(pairs, [2]*float64{point[0], point[1]})
+    }
+
+    return pairs
+}
+
+func TestRawParser(t *testing.T) {
+    body := []byte("sumSeries(a,b),100,130,10|1.5,None,3\ncpu,100,110,10|7\n")
+
+    dataPoints, err := ParseRender(RenderFormatRaw, body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(dataPoints) != 2 || dataPoints[0].Target != "sumSeries(a,b)" || dataPoints[1].Target != "cpu" {
+        t.Fatalf("got %+v, want sumSeries(a,b) and cpu", dataPoints)
+    }
+
+    got := values(dataPoints[0])
+    want := []struct {
+        value     *float64
+        timestamp float64
+    }{{ptr(1.5), 100}, {nil, 110}, {ptr(3), 120}}
+    if len(got) != len(want) {
+        t.Fatalf("got %d datapoints, want %d", len(got), len(want))
+    }
+    for i, w := range want {
+        if (got[i][0] == nil) != (w.value == nil) || w.value != nil && *got[i][0] != *w.value || *got[i][1] != w.timestamp {
+            t.Errorf("datapoint %d = %v at %v, want %v at %v", i, got[i][0], *got[i][1], w.value, w.timestamp)
+        }
+    }
+}
+
+func TestRawParserInvalid(t *testing.T) {
+    for _, body := range []string{"cpu,100,110,10", "cpu,100|1", "cpu,100,110,10|x"} {
+        if _, err := (RawParser{}).Parse([]byte(body)); err == nil {
+            t.Errorf("Parse(%q) succeeded, want an error", body)
+        }
+    }
+}
+
+func TestValidateSchema(t *testing.T) {
+    tests := []struct {
+        name    string
+        body    string
+        wantErr string
+    }{
+        {"valid", `[{"target": "cpu", "datapoints": [[1.5, 100], [null, 200]]}, {"target": "mem", "datapoints": []}]`, ""},
+        {"missing target", `[{"datapoints": [[1, 100]]}]`, "series 0: want a non-empty string target, got none"},
+        {"missing datapoints", `[{"target": "cpu"}]`, "series 0 (cpu): want a datapoints array"},
+        {"null datapoints", `[{"target": "cpu", "datapoints": null}]`, "series 0 (cpu): want a datapoints array, got null"},
+        {"three-element pair", `[{"target": "cpu", "datapoints": [[1, 100], [2, 200, 3]]}]`, "series 0 (cpu): datapoint 1: want [value, timestamp], got [2, 200, 3]"},
+        {"null timestamp", `[{"target": "cpu", "datapoints": [[1, null]]}]`, "datapoint 0: want a number timestamp, got null"},
+        {"second series", `[{"target": "cpu", "datapoints": []}, {"target": "", "datapoints": []}]`, "series 1: want a non-empty string target"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := JSONParser{Validate: true}.Parse([]byte(tt.body))
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+            }
+            if _, err := (JSONParser{}).Parse([]byte(tt.body)); err != nil {
+                t.Errorf("without Validate: %v, want the lenient decoding to succeed", err)
+            }
+        })
+    }
+}
@@ -0,0 +1,533 @@
+package graphite
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+)
+
+// DataPoint is a single series from a /render JSON response. Null values
+// are decoded as nil.
+type DataPoint struct {
+    Target     string            `json:"target"`
+    Tags       map[string]string `json:"tags"`
+    DataPoints [][]*float64      `json:"datapoints"`
+}
+
+// MetricStatistics summarizes the non-null datapoints of a metric.
+type MetricStatistics struct {
+    Count             int     `json:"count"`
+    Average           float64 `json:"average"`
+    Sum               float64 `json:"sum"`
+    Maximum           float64 `json:"maximum"`
+    Minimum           float64 `json:"minimum"`
+    StandardDeviation float64 `json:"standard_deviation"`
+    MaximumTimestamp  int64   `json:"maximum_timestamp"`
+    MinimumTimestamp  int64   `json:"minimum_timestamp"`
+    // FirstValue and LastValue are the non-null datapoints with the
+    // earliest and latest timestamps, whatever order they were returned in.
+    FirstValue     float64 `json:"first_value"`
+    FirstTimestamp int64   `json:"first_timestamp"`
+    LastValue      float64 `json:"last_value"`
+    LastTimestamp  int64   `json:"last_timestamp"`
+    // NullCount is the number of null or non-finite datapoints that were
+    // skipped.
+    NullCount int `json:"null_count"`
+    // DistinctTimestamps counts the unique timestamps of the datapoints
+    // used; it falls short of Count when a series repeats timestamps.
+    DistinctTimestamps int `json:"distinct_timestamps"`
+    // Completeness is the fraction of all datapoints that were used.
+    Completeness float64 `json:"completeness"`
+    // TrimmedAverage is set when StatsOptions.Trim is.
+    TrimmedAverage *float64 `json:"trimmed_average,omitempty"`
+    // Mode, set when StatsOptions.Mode is, is the most frequent value,
+    // ties going to the smallest.
+    Mode *float64 `json:"mode,omitempty"`
+    // EWMA is the exponentially weighted moving average of the datapoints
+    // in time order, set when StatsOptions.EWMA is.
+    EWMA        *float64           `json:"ewma,omitempty"`
+    Percentiles map[string]float64 `json:"percentiles,omitempty"`
+    Tags        map[string]string  `json:"tags,omitempty"`
+    // Labels are never computed here; they describe the metric's source
+    // and are attached by the caller.
+    Labels    map[string]string `json:"labels,omitempty"`
+    Histogram *Histogram        `json:"histogram,omitempty"`
+    // DataPoints, when requested, lists the [value, timestamp] pairs the
+    // statistics were computed from, in response order.
+    DataPoints [][2]float64      `json:"datapoints,omitempty"`
+    Delta      *Delta            `json:"delta,omitempty"`
+    Window     *WindowStatistics `json:"window,omitempty"`
+    // Rollups holds the statistics of each time bucket, keyed by the
+    // bucket's start time; see Rollups.
+    Rollups map[int64]MetricStatistics `json:"rollups,omitempty"`
+
+    // sample records that StandardDeviation is the sample (n-1) rather
+    // than the population (n) standard deviation.
+    sample bool
+}
+
+// Delta is the change of each statistic from an earlier time window to
+// the current one, current minus earlier; see CompareStatistics.
+type Delta struct {
+    Count             int     `json:"count"`
+    Average           float64 `json:"average"`
+    Sum               float64 `json:"sum"`
+    Maximum           float64 `json:"maximum"`
+    Minimum           float64 `json:"minimum"`
+    StandardDeviation float64 `json:"standard_deviation"`
+}
+
+// CompareStatistics returns how current differs from previous, the
+// statistics of the same metric over an earlier window.
+func CompareStatistics(current, previous MetricStatistics) *Delta {
+    return &Delta{
+        Count:             current.Count - previous.Count,
+        Average:           current.Average - previous.Average,
+        Sum:               current.Sum - previous.Sum,
+        Maximum:           current.Maximum - previous.Maximum,
+        Minimum:           current.Minimum - previous.Minimum,
+        StandardDeviation: current.StandardDeviation - previous.StandardDeviation,
+    }
+}
+
+// Histogram is an equal-width distribution of datapoint values between
+// the series minimum and maximum. Bounds holds the len(Buckets)+1 bucket
+// edges; every bucket is half-open except the last, which includes the
+// maximum.
+type Histogram struct {
+    Buckets []int     `json:"buckets"`
+    Bounds  []float64 `json:"bounds"`
+}
+
+// ErrNoData is returned by CalculateStatistics when there is no usable
+// datapoint. The statistics returned with it still carry NullCount.
+var ErrNoData = errors.New("no data points found")
+
+// StatsOptions selects the optional statistics computed by
+// CalculateStatistics.
+type StatsOptions struct {
+    Percentiles []float64
+    // SampleStdDev divides by n-1 instead of n; a single datapoint then
+    // has a standard deviation of 0.
+    SampleStdDev bool
+    // HistogramBuckets is the number of histogram buckets; 0 disables the
+    // histogram.
+    HistogramBuckets int
+    // Strict makes a malformed datapoint, one without both a value and a
+    // timestamp, an error. Otherwise empty datapoints are skipped.
+    Strict bool
+    // IncludeDataPoints keeps the datapoints used in MetricStatistics.
+    IncludeDataPoints bool
+    // Trim is the percentage, below 50, of the lowest and of the highest
+    // values discarded before computing TrimmedAverage; 0 disables it.
+    Trim float64
+    // Mode computes the most frequent value.
+    Mode bool
+    // EWMA is the smoothing factor alpha, in (0, 1], of the exponentially
+    // weighted moving average; 0 disables it.
+    EWMA float64
+}
+
+// CalculateStatistics summarizes every non-null datapoint across all of
+// the series in dataPoints.
+func CalculateStatistics(dataPoints []DataPoint, opts StatsOptions) (MetricStatistics, error) {
+    var sum, first, last, mean, m2 float64
+    var maxTimestamp, minTimestamp int64
+    var count, nulls int
+
+    // Start every extreme beyond any finite datapoint so that the first
+    // one used replaces them, whichever datapoints were skipped before it.
+    max, min := math.Inf(-1), math.Inf(1)
+    firstTimestamp, lastTimestamp := int64(math.MaxInt64), int64(math.MinInt64)
+    var values []float64
+    var used [][2]float64
+    timestamps := map[int64]struct{}{}
+
+    for _, dp := range dataPoints {
+        for i, point := range dp.DataPoints {
+            if opts.Strict && len(point) < 2 {
+                return MetricStatistics{}, fmt.Errorf("malformed datapoint %d of %s: want [value, timestamp], got %d elements", i, dp.Target, len(point))
+            }
+            if len(point) == 0 {
+                continue
+            }
+
+            value, ok := pointValue(point)
+            if !ok {
+                nulls++
+                continue
+            }
+            timestamp := pointTimestamp(point)
+            timestamps[timestamp] = struct{}{}
+            if len(opts.Percentiles) > 0 || opts.HistogramBuckets > 0 || opts.Trim > 0 || opts.Mode {
+                values = append(values, value)
+            }
+            if opts.IncludeDataPoints || opts.EWMA > 0 {
+                used = append(used, [2]float64{value, float64(timestamp)})
+            }
+            sum += value
+            if value > max || (value == max && timestamp < maxTimestamp) {
+                max = value
+                maxTimestamp = timestamp
+            }
+            if value < min || (value == min && timestamp < minTimestamp) {
+                min = value
+                minTimestamp = timestamp
+            }
+            if timestamp < firstTimestamp {
+                first = value
+                firstTimestamp = timestamp
+            }
+            if timestamp > lastTimestamp {
+                last = value
+                lastTimestamp = timestamp
+            }
+            count++
+
+            delta := value - mean
+            mean += delta / float64(count)
+            m2 += delta * (value - mean)
+        }
+    }
+
+    if count == 0 {
+        return MetricStatistics{NullCount: nulls}, ErrNoData
+    }
+
+    average := sum / float64(count)
+    stddev := stdDev(m2, count, opts.SampleStdDev)
+
+    stats := MetricStatistics{
+        Count:              count,
+        Average:            average,
+        Sum:                sum,
+        Maximum:            max,
+        Minimum:            min,
+        StandardDeviation:  stddev,
+        MaximumTimestamp:   maxTimestamp,
+        MinimumTimestamp:   minTimestamp,
+        FirstValue:         first,
+        FirstTimestamp:     firstTimestamp,
+        LastValue:          last,
+        LastTimestamp:      lastTimestamp,
+        NullCount:          nulls,
+        DistinctTimestamps: len(timestamps),
+        Completeness:       completeness(count, nulls),
+        sample:             opts.SampleStdDev,
+    }
+
+    stats.Tags = commonTags(dataPoints)
+
+    if len(opts.Percentiles) > 0 || opts.Trim > 0 || opts.Mode {
+        sort.Float64s(values)
+    }
+
+    if len(opts.Percentiles) > 0 {
+        stats.Percentiles = make(map[string]float64, len(opts.Percentiles))
+        for _, p := range opts.Percentiles {
+            stats.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = percentile(values, p)
+        }
+    }
+
+    if opts.Trim > 0 {
+        trimmed := trimmedMean(values, opts.Trim)
+        stats.TrimmedAverage = &trimmed
+    }
+
+    if opts.IncludeDataPoints {
+        stats.DataPoints = used
+    }
+
+    if opts.EWMA > 0 {
+        e := ewma(used, opts.EWMA)
+        stats.EWMA = &e
+    }
+
+    if opts.Mode {
+        m := mode(values)
+        stats.Mode = &m
+    }
+
+    if opts.HistogramBuckets > 0 {
+        stats.Histogram = histogram(values, min, max, opts.HistogramBuckets)
+    }
+
+    return stats, nil
+}
+
+func completeness(count, nulls int) float64 {
+    return float64(count) / float64(count+nulls)
+}
+
+// commonTags returns the tags shared, with identical values, by every
+// series in the response.
+func commonTags(dataPoints []DataPoint) map[string]string {
+    var tags map[string]string
+
+    for i, dp := range dataPoints {
+        if i == 0 {
+            for k, v := range dp.Tags {
+                if tags == nil {
+                    tags = map[string]string{}
+                }
+                tags[k] = v
+            }
+            continue
+        }
+        for k, v := range tags {
+            if dp.Tags[k] != v {
+                delete(tags, k)
+            }
+        }
+    }
+
+    if len(tags) == 0 {
+        return nil
+    }
+
+    return tags
+}
+
+// pointValue returns the value of point, reporting false for nulls,
+// non-finite values and empty points, which are excluded from every
+// statistic.
+func pointValue(point []*float64) (float64, bool) {
+    if len(point) == 0 || point[0] == nil || math.IsNaN(*point[0]) || math.IsInf(*point[0], 0) {
+        return 0, false
+    }
+
+    return *point[0], true
+}
+
+func pointTimestamp(point []*float64) int64 {
+    if len(point) < 2 || point[1] == nil {
+        return 0
+    }
+
+    return int64(*point[1])
+}
+
+func stdDev(m2 float64, count int, sample bool) float64 {
+    n := float64(count)
+    if sample {
+        n--
+    }
+    if n <= 0 || m2 <= 0 {
+        return 0
+    }
+
+    return math.Sqrt(m2 / n)
+}
+
+// percentile returns the p-th percentile (0-100) of sorted using linear
+// interpolation between closest ranks: the rank is p/100*(n-1) and the
+// result interpolates between the values at its floor and ceiling.
+func percentile(sorted []float64, p float64) float64 {
+    rank := p / 100 * float64(len(sorted)-1)
+    lower := int(math.Floor(rank))
+    upper := int(math.Ceil(rank))
+
+    return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// trimmedMean averages sorted without its lowest and highest p percent,
+// rounded down to whole values. When that would leave nothing, as for
+// very short series, it is the plain average.
+func trimmedMean(sorted []float64, p float64) float64 {
+    k := int(float64(len(sorted)) * p / 100)
+    if 2*k >= len(sorted) {
+        k = 0
+    }
+
+    var sum float64
+    for _, v := range sorted[k : len(sorted)-k] {
+        sum += v
+    }
+
+    return sum / float64(len(sorted)-2*k)
+}
+
+// ewma returns the exponentially weighted moving average of the [value,
+// timestamp] points taken in timestamp order: it starts at the earliest
+// value and each later value v moves it to alpha*v + (1-alpha)*ewma.
+// points is not modified.
+func ewma(points [][2]float64, alpha float64) float64 {
+    ordered := make([][2]float64, len(points))
+    copy(ordered, points)
+    sort.SliceStable(ordered, func(i, j int) bool { return ordered[i][1] < ordered[j][1] })
+
+    average := ordered[0][0]
+    for _, point := range ordered[1:] {
+        average = alpha*point[0] + (1-alpha)*average
+    }
+
+    return average
+}
+
+// mode returns the most frequent value of sorted. Of equally frequent
+// values the smallest wins, being the first run of that length.
+func mode(sorted []float64) float64 {
+    best, bestRun := sorted[0], 0
+    for start := 0; start < len(sorted); {
+        end := start + 1
+        for end < len(sorted) && sorted[end] == sorted[start] {
+            end++
+        }
+        if end-start > bestRun {
+            best, bestRun = sorted[start], end-start
+        }
+        start = end
+    }
+
+    return best
+}
+
+// histogram buckets values into n equal-width buckets spanning [min, max].
+// When every value is equal the range is empty and a single bucket holds
+// them all.
+func histogram(values []float64, min, max float64, n int) *Histogram {
+    if min == max {
+        return &Histogram{Buckets: []int{len(values)}, Bounds: []float64{min, max}}
+    }
+
+    h := &Histogram{Buckets: make([]int, n), Bounds: make([]float64, n+1)}
+    width := (max - min) / float64(n)
+    for i := range h.Bounds {
+        h.Bounds[i] = min + width*float64(i)
+    }
+    h.Bounds[n] = max
+
+    for _, v := range values {
+        i := int((v - min) / width)
+        if i >= n {
+            i = n - 1
+        }
+        h.Buckets[i]++
+    }
+
+    return h
+}
+
+// Aggregate merges statistics computed over disjoint sets of datapoints;
+// see MetricStatistics.Merge.
+func Aggregate(stats ...MetricStatistics) MetricStatistics {
+    var total MetricStatistics
+    for _, s := range stats {
+        total = total.Merge(s)
+    }
+
+    return total
+}
+
+// withNulls returns s with nulls more null datapoints, as when merging
+// with statistics that have no values.
+func (s MetricStatistics) withNulls(nulls int) MetricStatistics {
+    if nulls == 0 {
+        return s
+    }
+    s.NullCount += nulls
+    s.Completeness = completeness(s.Count, s.NullCount)
+
+    return s
+}
+
+// Merge combines s and other as if they had been computed over the union
+// of their datapoints. Averages are weighted by count and standard
+// deviations are pooled with the parallel variance formula of Chan et al.
+// Percentiles, histograms and distinct timestamps cannot be combined this
+// way and are dropped, as are trimmed averages, modes, EWMAs, tags,
+// labels, datapoints, deltas and windowed statistics; rollups are merged
+// bucket by bucket.
+func (s MetricStatistics) Merge(other MetricStatistics) MetricStatistics {
+    if other.Count == 0 {
+        return s.withoutSeriesFields().withNulls(other.NullCount)
+    }
+    if s.Count == 0 {
+        return other.withoutSeriesFields().withNulls(s.NullCount)
+    }
+
+    n := s.Count + other.Count
+    delta := other.Average - s.Average
+    m2 := s.m2() + other.m2() + delta*delta*float64(s.Count)*float64(other.Count)/float64(n)
+
+    merged := MetricStatistics{
+        Count:            n,
+        Average:          s.Average + delta*float64(other.Count)/float64(n),
+        Sum:              s.Sum + other.Sum,
+        Maximum:          s.Maximum,
+        Minimum:          s.Minimum,
+        MaximumTimestamp: s.MaximumTimestamp,
+        MinimumTimestamp: s.MinimumTimestamp,
+        FirstValue:       s.FirstValue,
+        FirstTimestamp:   s.FirstTimestamp,
+        LastValue:        s.LastValue,
+        LastTimestamp:    s.LastTimestamp,
+        NullCount:        s.NullCount + other.NullCount,
+        sample:           s.sample,
+    }
+    merged.Completeness = completeness(merged.Count, merged.NullCount)
+    if other.Maximum > merged.Maximum || (other.Maximum == merged.Maximum && other.MaximumTimestamp < merged.MaximumTimestamp) {
+        merged.Maximum = other.Maximum
+        merged.MaximumTimestamp = other.MaximumTimestamp
+    }
+    if other.Minimum < merged.Minimum || (other.Minimum == merged.Minimum && other.MinimumTimestamp < merged.MinimumTimestamp) {
+        merged.Minimum = other.Minimum
+        merged.MinimumTimestamp = other.MinimumTimestamp
+    }
+    if other.FirstTimestamp < merged.FirstTimestamp {
+        merged.FirstValue = other.FirstValue
+        merged.FirstTimestamp = other.FirstTimestamp
+    }
+    if other.LastTimestamp > merged.LastTimestamp {
+        merged.LastValue = other.LastValue
+        merged.LastTimestamp = other.LastTimestamp
+    }
+    merged.StandardDeviation = stdDev(m2, n, merged.sample)
+
+    if s.Rollups != nil || other.Rollups != nil {
+        merged.Rollups = s.withoutSeriesFields().Rollups
+        if merged.Rollups == nil {
+            merged.Rollups = map[int64]MetricStatistics{}
+        }
+        for start, stats := range other.Rollups {
+            merged.Rollups[start] = merged.Rollups[start].Merge(stats)
+        }
+    }
+
+    return merged
+}
+
+// m2 recovers the sum of squared deviations from the mean.
+func (s MetricStatistics) m2() float64 {
+    dof := float64(s.Count)
+    if s.sample {
+        dof--
+    }
+
+    return s.StandardDeviation * s.StandardDeviation * dof
+}
+
+// withoutSeriesFields drops the fields Merge cannot combine.
+func (s MetricStatistics) withoutSeriesFields() MetricStatistics {
+    s.Percentiles = nil
+    s.TrimmedAverage = nil
+    s.Mode = nil
+    s.EWMA = nil
+    s.Tags = nil
+    s.Labels = nil
+    s.Histogram = nil
+    s.DistinctTimestamps = 0
+    s.DataPoints = nil
+    s.Delta = nil
+    s.Window = nil
+    if s.Rollups != nil {
+        rollups := make(map[int64]MetricStatistics, len(s.Rollups))
+        for start, stats := range s.Rollups {
+            rollups[start] = stats.withoutSeriesFields()
+        }
+        s.Rollups = rollups
+    }
+    return s
+}
@@ -0,0 +1,552 @@
+package graphite
+
+import (
+    "errors"
+    "math"
+    "reflect"
+    "testing"
+)
+
+func ptr(v float64) *float64 {
+    return &v
+}
+
+// series returns a single series of values at timestamps 1, 2, ...; a nil
+// value is a null datapoint.
+func series(values ...*float64) []DataPoint {
+    dp := DataPoint{Target: "cpu"}
+    for i, v := range values {
+        dp.DataPoints = append(dp.DataPoints, []*float64{v, ptr(float64(i + 1))})
+    }
+
+    return []DataPoint{dp}
+}
+
+// floats is like series for values without nulls.
+func floats(values ...float64) []DataPoint {
+    var ptrs []*float64
+    for _, v := range values {
+        ptrs = append(ptrs, ptr(v))
+    }
+
+    return series(ptrs...)
+}
+
+func TestNullDatapoints(t *testing.T) {
+    tests := []struct {
+        name        string
+        data        []DataPoint
+        wantCount   int
+        wantNulls   int
+        wantAverage float64
+        wantMinimum float64
+    }{
+        {"no nulls", floats(2, 4), 2, 0, 3, 2},
+        {"nulls skipped, not zero", series(ptr(2), nil, ptr(4), nil), 2, 2, 3, 2},
+        {"leading null", series(nil, ptr(5)), 1, 1, 5, 5},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Count != tt.wantCount || stats.NullCount != tt.wantNulls {
+                t.Errorf("count = %d, nulls = %d, want %d and %d", stats.Count, stats.NullCount, tt.wantCount, tt.wantNulls)
+            }
+            if stats.Average != tt.wantAverage || stats.Minimum != tt.wantMinimum {
+                t.Errorf("average = %v, minimum = %v, want %v and %v", stats.Average, stats.Minimum, tt.wantAverage, tt.wantMinimum)
+            }
+        })
+    }
+}
+
+func TestAllNullDatapoints(t *testing.T) {
+    stats, err := CalculateStatistics(series(nil, nil), StatsOptions{})
+    if !errors.Is(err, ErrNoData) {
+        t.Fatalf("error = %v, want ErrNoData", err)
+    }
+    if stats.NullCount != 2 {
+        t.Errorf("null count = %d, want 2", stats.NullCount)
+    }
+}
+
+func TestPercentiles(t *testing.T) {
+    tests := []struct {
+        name   string
+        values []float64
+        want   map[string]float64
+    }{
+        {"odd", []float64{5, 1, 3}, map[string]float64{"p50": 3, "p90": 4.6, "p100": 5}},
+        {"even", []float64{4, 1, 3, 2}, map[string]float64{"p50": 2.5, "p90": 3.7, "p100": 4}},
+        {"single", []float64{7}, map[string]float64{"p50": 7, "p90": 7, "p100": 7}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(floats(tt.values...), StatsOptions{Percentiles: []float64{50, 90, 100}})
+            if err != nil {
+                t.Fatal(err)
+            }
+            for key, want := range tt.want {
+                if got, ok := stats.Percentiles[key]; !ok || math.Abs(got-want) > 1e-9 {
+                    t.Errorf("%s = %v (present %t), want %v", key, got, ok, want)
+                }
+            }
+        })
+    }
+}
+
+// closeTo reports whether a and b differ by no more than a relative 1e-9.
+func closeTo(a, b float64) bool {
+    return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func TestAggregate(t *testing.T) {
+    a, err := CalculateStatistics(floats(1, 2, 3), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := CalculateStatistics(floats(10, 20), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    want, err := CalculateStatistics(floats(1, 2, 3, 10, 20), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    got := Aggregate(a, b)
+    if got.Count != 5 || got.Sum != 36 || got.Maximum != 20 || got.Minimum != 1 {
+        t.Errorf("count, sum, max, min = %d, %v, %v, %v, want 5, 36, 20, 1", got.Count, got.Sum, got.Maximum, got.Minimum)
+    }
+    // The weighted average is 7.2, not the 8.5 average of the averages.
+    if !closeTo(got.Average, 7.2) {
+        t.Errorf("average = %v, want 7.2", got.Average)
+    }
+    if !closeTo(got.StandardDeviation, want.StandardDeviation) {
+        t.Errorf("pooled standard deviation = %v, want %v", got.StandardDeviation, want.StandardDeviation)
+    }
+}
+
+func TestStandardDeviationLargeValues(t *testing.T) {
+    // A naive sum-of-squares variance loses every significant digit here.
+    stats, err := CalculateStatistics(floats(1e9, 1e9+1, 1e9+2), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if want := math.Sqrt(2.0 / 3); !closeTo(stats.StandardDeviation, want) {
+        t.Errorf("standard deviation = %v, want %v", stats.StandardDeviation, want)
+    }
+}
+
+func TestSampleStandardDeviation(t *testing.T) {
+    tests := []struct {
+        name   string
+        values []float64
+        sample bool
+        want   float64
+    }{
+        {"population", []float64{2, 4, 4, 4, 5, 5, 7, 9}, false, 2},
+        {"sample", []float64{2, 4, 4, 4, 5, 5, 7, 9}, true, math.Sqrt(32.0 / 7)},
+        {"population of one", []float64{3}, false, 0},
+        {"sample of one", []float64{3}, true, 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(floats(tt.values...), StatsOptions{SampleStdDev: tt.sample})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !closeTo(stats.StandardDeviation, tt.want) {
+                t.Errorf("standard deviation = %v, want %v", stats.StandardDeviation, tt.want)
+            }
+        })
+    }
+}
+
+// timed returns a single series of [value, timestamp] pairs.
+func timed(pairs ...[2]float64) []DataPoint {
+    dp := DataPoint{Target: "cpu"}
+    for _, p := range pairs {
+        dp.DataPoints = append(dp.DataPoints, []*float64{ptr(p[0]), ptr(p[1])})
+    }
+
+    return []DataPoint{dp}
+}
+
+func TestExtremeTimestamps(t *testing.T) {
+    tests := []struct {
+        name             string
+        data             []DataPoint
+        wantMaxTime      int64
+        wantMinTime      int64
+        wantMax, wantMin float64
+    }{
+        {"distinct", timed([2]float64{3, 10}, [2]float64{9, 20}, [2]float64{1, 30}), 20, 30, 9, 1},
+        {"ties go to the earliest", floats(5, 1, 5, 1), 1, 2, 5, 1},
+        {"ties out of order", timed([2]float64{5, 30}, [2]float64{5, 10}, [2]float64{5, 20}), 10, 10, 5, 5},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Maximum != tt.wantMax || stats.MaximumTimestamp != tt.wantMaxTime {
+                t.Errorf("maximum = %v at %d, want %v at %d", stats.Maximum, stats.MaximumTimestamp, tt.wantMax, tt.wantMaxTime)
+            }
+            if stats.Minimum != tt.wantMin || stats.MinimumTimestamp != tt.wantMinTime {
+                t.Errorf("minimum = %v at %d, want %v at %d", stats.Minimum, stats.MinimumTimestamp, tt.wantMin, tt.wantMinTime)
+            }
+        })
+    }
+}
+
+func TestNonFiniteValues(t *testing.T) {
+    stats, err := CalculateStatistics(series(ptr(1), ptr(math.NaN()), ptr(math.Inf(1)), ptr(3), ptr(math.Inf(-1))), StatsOptions{Percentiles: []float64{50}})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if stats.Count != 2 || stats.NullCount != 3 {
+        t.Errorf("count = %d, nulls = %d, want 2 and 3", stats.Count, stats.NullCount)
+    }
+    if stats.Average != 2 || stats.Maximum != 3 || stats.Minimum != 1 || stats.Percentiles["p50"] != 2 {
+        t.Errorf("average, max, min, p50 = %v, %v, %v, %v, want 2, 3, 1, 2", stats.Average, stats.Maximum, stats.Minimum, stats.Percentiles["p50"])
+    }
+}
+
+func TestOnlyNonFiniteValues(t *testing.T) {
+    _, err := CalculateStatistics(series(ptr(math.NaN()), ptr(math.Inf(1))), StatsOptions{})
+    if !errors.Is(err, ErrNoData) {
+        t.Errorf("error = %v, want ErrNoData", err)
+    }
+}
+
+func TestMerge(t *testing.T) {
+    values := []*float64{ptr(4), nil, ptr(-2), ptr(7), ptr(7), nil, ptr(1.5), ptr(3)}
+
+    for split := 1; split < len(values); split++ {
+        whole, err := CalculateStatistics(series(values...), StatsOptions{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        // Both halves keep their timestamps, as consecutive windows would.
+        first := series(values...)
+        second := series(values...)
+        first[0].DataPoints = first[0].DataPoints[:split]
+        second[0].DataPoints = second[0].DataPoints[split:]
+
+        a, errA := CalculateStatistics(first, StatsOptions{})
+        b, errB := CalculateStatistics(second, StatsOptions{})
+        if errA != nil && !errors.Is(errA, ErrNoData) || errB != nil && !errors.Is(errB, ErrNoData) {
+            t.Fatal(errA, errB)
+        }
+        got := a.Merge(b)
+
+        if got.Count != whole.Count || got.Sum != whole.Sum || got.Maximum != whole.Maximum || got.Minimum != whole.Minimum {
+            t.Errorf("split at %d: count, sum, max, min = %d, %v, %v, %v, want %d, %v, %v, %v", split, got.Count, got.Sum, got.Maximum, got.Minimum, whole.Count, whole.Sum, whole.Maximum, whole.Minimum)
+        }
+        if got.MaximumTimestamp != whole.MaximumTimestamp || got.FirstValue != whole.FirstValue || got.LastValue != whole.LastValue {
+            t.Errorf("split at %d: max timestamp, first, last = %d, %v, %v, want %d, %v, %v", split, got.MaximumTimestamp, got.FirstValue, got.LastValue, whole.MaximumTimestamp, whole.FirstValue, whole.LastValue)
+        }
+        if !closeTo(got.Average, whole.Average) || !closeTo(got.StandardDeviation, whole.StandardDeviation) {
+            t.Errorf("split at %d: average, stddev = %v, %v, want %v, %v", split, got.Average, got.StandardDeviation, whole.Average, whole.StandardDeviation)
+        }
+        if got.NullCount != whole.NullCount || !closeTo(got.Completeness, whole.Completeness) {
+            t.Errorf("split at %d: nulls, completeness = %d, %v, want %d, %v", split, got.NullCount, got.Completeness, whole.NullCount, whole.Completeness)
+        }
+    }
+}
+
+func TestHistogram(t *testing.T) {
+    tests := []struct {
+        name        string
+        values      []float64
+        buckets     int
+        wantBuckets []int
+        wantBounds  []float64
+    }{
+        {"maximum in last bucket", []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 5, []int{2, 2, 2, 2, 3}, []float64{0, 2, 4, 6, 8, 10}},
+        {"skewed", []float64{1, 1, 1, 1, 9}, 2, []int{4, 1}, []float64{1, 5, 9}},
+        {"all equal", []float64{3, 3, 3}, 4, []int{3}, []float64{3, 3}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(floats(tt.values...), StatsOptions{HistogramBuckets: tt.buckets})
+            if err != nil {
+                t.Fatal(err)
+            }
+            h := stats.Histogram
+            if h == nil {
+                t.Fatal("no histogram")
+            }
+            if !reflect.DeepEqual(h.Buckets, tt.wantBuckets) || !reflect.DeepEqual(h.Bounds, tt.wantBounds) {
+                t.Errorf("histogram = %v / %v, want %v / %v", h.Buckets, h.Bounds, tt.wantBuckets, tt.wantBounds)
+            }
+
+            var sum int
+            for _, n := range h.Buckets {
+                sum += n
+            }
+            if sum != stats.Count {
+                t.Errorf("buckets sum to %d, want the count %d", sum, stats.Count)
+            }
+        })
+    }
+}
+
+func TestCompleteness(t *testing.T) {
+    tests := []struct {
+        name string
+        data []DataPoint
+        want float64
+    }{
+        {"half", series(ptr(1), nil, ptr(2), nil), 0.5},
+        {"complete", floats(1, 2, 3), 1},
+        {"non-finite count as missing", series(ptr(1), ptr(math.NaN()), ptr(2), ptr(3)), 0.75},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Completeness != tt.want {
+                t.Errorf("completeness = %v, want %v", stats.Completeness, tt.want)
+            }
+        })
+    }
+}
+
+func TestFirstAndLastOutOfOrder(t *testing.T) {
+    data := timed([2]float64{2, 200}, [2]float64{3, 300}, [2]float64{1, 100}, [2]float64{5, 50})
+    data[0].DataPoints = append([][]*float64{{nil, ptr(10)}}, data[0].DataPoints...)
+    data[0].DataPoints = append(data[0].DataPoints, []*float64{nil, ptr(999)})
+
+    stats, err := CalculateStatistics(data, StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Nulls at either end are ignored; order in the response does not matter.
+    if stats.FirstValue != 5 || stats.FirstTimestamp != 50 {
+        t.Errorf("first = %v at %d, want 5 at 50", stats.FirstValue, stats.FirstTimestamp)
+    }
+    if stats.LastValue != 3 || stats.LastTimestamp != 300 {
+        t.Errorf("last = %v at %d, want 3 at 300", stats.LastValue, stats.LastTimestamp)
+    }
+}
+
+func TestMalformedDatapoints(t *testing.T) {
+    data := floats(1, 2)
+    data[0].DataPoints = append(data[0].DataPoints, []*float64{}, []*float64{ptr(9)})
+
+    tests := []struct {
+        name      string
+        strict    bool
+        wantErr   bool
+        wantCount int
+    }{
+        // The empty datapoint is skipped; the one without a timestamp is
+        // used as it is.
+        {"lenient", false, false, 3},
+        {"strict", true, true, 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(data, StatsOptions{Strict: tt.strict})
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+            }
+            if err != nil && err.Error() != "malformed datapoint 2 of cpu: want [value, timestamp], got 0 elements" {
+                t.Errorf("error = %v, want it to locate the empty datapoint", err)
+            }
+            if stats.Count != tt.wantCount {
+                t.Errorf("count = %d, want %d", stats.Count, tt.wantCount)
+            }
+        })
+    }
+}
+
+func TestMergeKeepsNullsOfEmptySide(t *testing.T) {
+    nulls, err := CalculateStatistics(series(nil, nil), StatsOptions{})
+    if !errors.Is(err, ErrNoData) {
+        t.Fatalf("error = %v, want ErrNoData", err)
+    }
+    values, err := CalculateStatistics(series(ptr(1), ptr(3)), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for name, got := range map[string]MetricStatistics{
+        "empty merged into data": values.Merge(nulls),
+        "data merged into empty": nulls.Merge(values),
+    } {
+        if got.Count != 2 || got.NullCount != 2 || got.Completeness != 0.5 {
+            t.Errorf("%s: count, nulls, completeness = %d, %d, %v, want 2, 2, 0.5", name, got.Count, got.NullCount, got.Completeness)
+        }
+    }
+}
+
+func TestDistinctTimestamps(t *testing.T) {
+    tests := []struct {
+        name  string
+        data  []DataPoint
+        count int
+        want  int
+    }{
+        {"unique", timed([2]float64{1, 100}, [2]float64{2, 200}, [2]float64{3, 300}), 3, 3},
+        {"duplicated", timed([2]float64{1, 100}, [2]float64{2, 100}, [2]float64{3, 200}, [2]float64{4, 200}), 4, 2},
+        {"across series", append(timed([2]float64{1, 100}, [2]float64{2, 200}), timed([2]float64{3, 100}, [2]float64{4, 300})...), 4, 3},
+        {"nulls ignored", series(ptr(1), nil, ptr(3)), 2, 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Count != tt.count || stats.DistinctTimestamps != tt.want {
+                t.Errorf("count, distinct timestamps = %d, %d, want %d, %d", stats.Count, stats.DistinctTimestamps, tt.count, tt.want)
+            }
+        })
+    }
+}
+
+func TestAllNegativeValues(t *testing.T) {
+    tests := []struct {
+        name    string
+        data    []DataPoint
+        wantMax float64
+        wantMin float64
+    }{
+        {"negative", floats(-5, -1.5, -9), -1.5, -9},
+        {"leading nulls", series(nil, nil, ptr(-3), ptr(-7)), -3, -7},
+        {"single", floats(-2), -2, -2},
+        {"positive", floats(4, 2, 8), 8, 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Maximum != tt.wantMax || stats.Minimum != tt.wantMin {
+                t.Errorf("max, min = %v, %v, want %v, %v", stats.Maximum, stats.Minimum, tt.wantMax, tt.wantMin)
+            }
+        })
+    }
+}
+
+func TestTrimmedAverage(t *testing.T) {
+    // Spikes at both ends around values averaging 5.
+    spiky := floats(5, 6, 4, 5, 1000, 5, 6, 4, 5, -50)
+
+    tests := []struct {
+        name string
+        data []DataPoint
+        trim float64
+        want float64
+    }{
+        {"one value trimmed from each end", spiky, 10, 5},
+        {"two values trimmed from each end", spiky, 20, 5},
+        {"rounded down", spiky, 19, 5},
+        // Too short to lose a value at either end: the plain average.
+        {"two values", floats(1, 100), 40, 50.5},
+        {"single value", floats(7), 49, 7},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{Trim: tt.trim})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.TrimmedAverage == nil || *stats.TrimmedAverage != tt.want {
+                t.Errorf("trimmed average = %v, want %v", stats.TrimmedAverage, tt.want)
+            }
+        })
+    }
+
+    stats, err := CalculateStatistics(spiky, StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats.TrimmedAverage != nil || stats.Average != 99 {
+        t.Errorf("without Trim: trimmed average, average = %v, %v, want nil, 99", stats.TrimmedAverage, stats.Average)
+    }
+}
+
+func TestMode(t *testing.T) {
+    tests := []struct {
+        name string
+        data []DataPoint
+        want float64
+    }{
+        {"clear mode", floats(2, 7, 2, 3, 2, 7), 2},
+        {"tie goes to the smallest", floats(9, 4, 9, 4, 1), 4},
+        {"all distinct", floats(5, 3, 8), 3},
+        {"nulls ignored", series(nil, ptr(6), nil, ptr(6), ptr(1)), 6},
+        {"negative", floats(-1, -1, 0), -1},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{Mode: true})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.Mode == nil || *stats.Mode != tt.want {
+                t.Errorf("mode = %v, want %v", stats.Mode, tt.want)
+            }
+        })
+    }
+
+    stats, err := CalculateStatistics(floats(1, 1, 2), StatsOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stats.Mode != nil {
+        t.Errorf("mode without StatsOptions.Mode = %v, want nil", *stats.Mode)
+    }
+}
+
+func TestEWMA(t *testing.T) {
+    tests := []struct {
+        name  string
+        data  []DataPoint
+        alpha float64
+        want  float64
+    }{
+        // 10, then 0.5*20 + 0.5*10 = 15, then 0.5*30 + 0.5*15 = 22.5.
+        {"hand computed", floats(10, 20, 30), 0.5, 22.5},
+        {"time order", timed([2]float64{30, 300}, [2]float64{10, 100}, [2]float64{20, 200}), 0.5, 22.5},
+        // 4, then 0.25*8 + 0.75*4 = 5, then 0.25*1 + 0.75*5 = 4.
+        {"nulls skipped", series(ptr(4), nil, ptr(8), nil, ptr(1)), 0.25, 4},
+        {"alpha 1 is the last value", floats(3, 9, 6), 1, 6},
+        {"single value", floats(7), 0.3, 7},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            stats, err := CalculateStatistics(tt.data, StatsOptions{EWMA: tt.alpha})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if stats.EWMA == nil || !closeTo(*stats.EWMA, tt.want) {
+                t.Errorf("EWMA = %v, want %v", stats.EWMA, tt.want)
+            }
+        })
+    }
+}
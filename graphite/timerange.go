@@ -0,0 +1,188 @@
+package graphite
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var relativeTime = regexp.MustCompile(`^-(\d+)([a-z]+)$`)
+
+// ErrUnknownTime is returned by ResolveTime for a value outside the forms
+// it resolves. Graphite understands many more, such as "midnight" or
+// "16:00_20240102", so callers pass such values on unchecked.
+var ErrUnknownTime = errors.New("expected now, -N<unit>, YYYYMMDD, a Unix epoch or an RFC 3339 timestamp")
+
+// relativeUnits are the units of a relative offset, matched like
+// graphite-web does: by prefix, in this order, so that "-1d", "-1day" and
+// "-1days" are all a day, and "min" and "mon" tell minutes from months.
+var relativeUnits = []struct {
+    prefix string
+    unit   time.Duration
+}{
+    {"s", time.Second},
+    {"min", time.Minute},
+    {"h", time.Hour},
+    {"d", 24 * time.Hour},
+    {"w", 7 * 24 * time.Hour},
+    {"mon", 30 * 24 * time.Hour},
+    {"y", 365 * 24 * time.Hour},
+}
+
+// relativeUnit returns the duration of the unit name, or 0 if it is not
+// a unit Graphite understands.
+func relativeUnit(name string) time.Duration {
+    for _, u := range relativeUnits {
+        if strings.HasPrefix(name, u.prefix) {
+            return u.unit
+        }
+    }
+
+    return 0
+}
+
+// ResolveTime converts a from/until value ("now", a Graphite relative
+// offset such as "-7d" or "-1hour", a YYYYMMDD date in now's location, a
+// Unix epoch or an RFC 3339 timestamp) to an absolute time. Any other
+// value is an error wrapping ErrUnknownTime, but for an offset in a unit
+// Graphite does not know either.
+func ResolveTime(value string, now time.Time) (time.Time, error) {
+    value = strings.TrimSpace(value)
+
+    if value == "now" {
+        return now, nil
+    }
+    if m := relativeTime.FindStringSubmatch(value); m != nil {
+        unit := relativeUnit(m[2])
+        if unit == 0 {
+            return time.Time{}, fmt.Errorf("invalid time %q: unknown unit %q", value, m[2])
+        }
+        n, err := strconv.Atoi(m[1])
+        if err != nil {
+            return time.Time{}, fmt.Errorf("invalid time %q: %v", value, err)
+        }
+        return now.Add(-time.Duration(n) * unit), nil
+    }
+    // Like graphite-web, eight digits that make a plausible date are a
+    // YYYYMMDD date rather than an epoch.
+    if len(value) == 8 && value > "1900" {
+        if t, err := time.ParseInLocation("20060102", value, now.Location()); err == nil {
+            return t, nil
+        }
+    }
+    if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+        return time.Unix(epoch, 0), nil
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+
+    return time.Time{}, fmt.Errorf("invalid time %q: %w", value, ErrUnknownTime)
+}
+
+// NormalizeTime returns value in a form Graphite accepts: RFC 3339
+// timestamps become Unix epochs, anything else is passed on unchanged but
+// for surrounding whitespace. Only empty values and offsets in unknown
+// units are rejected; see ErrUnknownTime.
+func NormalizeTime(value string) (string, error) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return "", errors.New("empty time")
+    }
+    if _, err := ResolveTime(value, time.Now()); err != nil && !errors.Is(err, ErrUnknownTime) {
+        return "", err
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return strconv.FormatInt(t.Unix(), 10), nil
+    }
+
+    return value, nil
+}
+
+// ValidateRange reports an error unless from resolves to a time before
+// until, both taken relative to now. A range with a bound ResolveTime does
+// not know is left for Graphite to check.
+func ValidateRange(from, until string, now time.Time) error {
+    start, err := ResolveTime(from, now)
+    if errors.Is(err, ErrUnknownTime) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    end, err := ResolveTime(until, now)
+    if errors.Is(err, ErrUnknownTime) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if !start.Before(end) {
+        return fmt.Errorf("from %q (%s) is not before until %q (%s)", from, start.UTC().Format(time.RFC3339), until, end.UTC().Format(time.RFC3339))
+    }
+
+    return nil
+}
+
+// chunkRange splits [from, until) into consecutive windows of at most size.
+// Windows end on multiples of size, as rounded by time.Truncate, so that a
+// relative range resolved a little later still yields the same full
+// windows in between, and hits their cache entries.
+func chunkRange(from, until time.Time, size time.Duration) [][2]time.Time {
+    var chunks [][2]time.Time
+    for start := from; start.Before(until); {
+        end := start.Truncate(size).Add(size)
+        if end.After(until) {
+            end = until
+        }
+        chunks = append(chunks, [2]time.Time{start, end})
+        start = end
+    }
+
+    return chunks
+}
+
+// mergeChunks concatenates the series of chronologically ordered chunks by
+// target. A point not newer than the last timestamp of the target's
+// previous chunks is dropped, so that a point on a chunk boundary is only
+// counted once; points within a chunk are all kept, in the order Graphite
+// returned them.
+func mergeChunks(chunks [][]DataPoint) []DataPoint {
+    var merged []DataPoint
+    index := map[string]int{}
+    boundary := map[string]int64{}
+
+    for _, chunk := range chunks {
+        newest := map[string]int64{}
+        for _, dp := range chunk {
+            i, ok := index[dp.Target]
+            if !ok {
+                i = len(merged)
+                index[dp.Target] = i
+                merged = append(merged, DataPoint{Target: dp.Target, Tags: dp.Tags})
+            }
+
+            for _, point := range dp.DataPoints {
+                timestamp := pointTimestamp(point)
+                if seen, ok := boundary[dp.Target]; ok && timestamp <= seen {
+                    continue
+                }
+                if n, ok := newest[dp.Target]; !ok || timestamp > n {
+                    newest[dp.Target] = timestamp
+                }
+                merged[i].DataPoints = append(merged[i].DataPoints, point)
+            }
+        }
+
+        for target, timestamp := range newest {
+            if seen, ok := boundary[target]; !ok || timestamp > seen {
+                boundary[target] = timestamp
+            }
+        }
+    }
+
+    return merged
+}
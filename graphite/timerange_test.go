@@ -0,0 +1,204 @@
+package graphite
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// windowServer serves an hourly series over [from, until], both inclusive
+// like Graphite's, so that consecutive windows share their boundary point.
+func windowServer(t *testing.T, requests *int) *httptest.Server {
+    t.Helper()
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        *requests++
+        from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+        until, _ := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+
+        var points []string
+        for ts := from - from%3600; ts <= until; ts += 3600 {
+            if ts >= from {
+                points = append(points, fmt.Sprintf("[%d, %d]", ts%7, ts))
+            }
+        }
+        fmt.Fprintf(w, `[{"target": "cpu", "datapoints": [%s]}]`, strings.Join(points, ","))
+    }))
+    t.Cleanup(srv.Close)
+
+    return srv
+}
+
+func TestChunkedData(t *testing.T) {
+    var requests int
+    srv := windowServer(t, &requests)
+    client := NewClient(srv.URL, srv.Client())
+    from, until := "1700006400", "1700179200"
+
+    whole, err := client.DataIn(context.Background(), "cpu", from, until)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    requests = 0
+    client.ChunkSize = 24 * time.Hour
+    chunked, err := client.DataIn(context.Background(), "cpu", from, until)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if requests != 2 {
+        t.Errorf("%d requests for two days in one-day chunks, want 2", requests)
+    }
+    if !reflect.DeepEqual(pairs(chunked), pairs(whole)) {
+        t.Errorf("chunked series differs from the single window:\n%v\nwant:\n%v", pairs(chunked), pairs(whole))
+    }
+}
+
+func TestChunkedDataUnknownTime(t *testing.T) {
+    var froms []string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        froms = append(froms, r.URL.Query().Get("from"))
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    client := NewClient(srv.URL, srv.Client())
+    client.ChunkSize = 24 * time.Hour
+    if _, err := client.DataIn(context.Background(), "cpu", "midnight", "now"); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(froms, []string{"midnight"}) {
+        t.Errorf("requested from = %q, want one unchunked request from midnight", froms)
+    }
+}
+
+func TestMergeChunks(t *testing.T) {
+    tests := []struct {
+        name   string
+        chunks [][]DataPoint
+        want   [][2]float64
+    }{
+        {
+            "boundary point counted once",
+            [][]DataPoint{timed([2]float64{1, 10}, [2]float64{2, 20}), timed([2]float64{2, 20}, [2]float64{3, 30})},
+            [][2]float64{{1, 10}, {2, 20}, {3, 30}},
+        },
+        {
+            "points within a chunk all kept",
+            [][]DataPoint{timed([2]float64{1, 20}, [2]float64{2, 10}, [2]float64{3, 10}), timed([2]float64{4, 30})},
+            [][2]float64{{1, 20}, {2, 10}, {3, 10}, {4, 30}},
+        },
+        {
+            "only points past the previous chunks kept",
+            [][]DataPoint{timed([2]float64{1, 10}, [2]float64{2, 30}), timed([2]float64{3, 20}, [2]float64{4, 40}, [2]float64{5, 35})},
+            [][2]float64{{1, 10}, {2, 30}, {4, 40}, {5, 35}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := pairs(mergeChunks(tt.chunks)); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("mergeChunks = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestResolveTime(t *testing.T) {
+    now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        value string
+        want  time.Time
+    }{
+        {"now", now},
+        {" -1h ", now.Add(-time.Hour)},
+        {"-90s", now.Add(-90 * time.Second)},
+        {"-5min", now.Add(-5 * time.Minute)},
+        {"-5minutes", now.Add(-5 * time.Minute)},
+        {"-2hours", now.Add(-2 * time.Hour)},
+        {"-7d", now.AddDate(0, 0, -7)},
+        {"-1days", now.AddDate(0, 0, -1)},
+        {"-2w", now.AddDate(0, 0, -14)},
+        {"-1mon", now.AddDate(0, 0, -30)},
+        {"-1y", now.AddDate(0, 0, -365)},
+        {"1700000000", time.Unix(1700000000, 0)},
+        {"20240102", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+        {"99999999", time.Unix(99999999, 0)},
+        {"2024-01-02T15:04:05Z", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+        {"2024-01-02T16:04:05+01:00", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+    }
+
+    for _, tt := range tests {
+        got, err := ResolveTime(tt.value, now)
+        if err != nil || !got.Equal(tt.want) {
+            t.Errorf("ResolveTime(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+        }
+    }
+
+    // "m" is neither minutes nor months; graphite-web rejects it too.
+    for _, value := range []string{"-5m", "-1x"} {
+        if got, err := ResolveTime(value, now); err == nil || errors.Is(err, ErrUnknownTime) {
+            t.Errorf("ResolveTime(%q) = %s, %v, want an unknown unit error", value, got, err)
+        }
+    }
+    for _, value := range []string{"", "+1h", "yesterday", "midnight", "16:00_20240102", "2024-01-02", "-1.5h", "-1d2h"} {
+        if got, err := ResolveTime(value, now); !errors.Is(err, ErrUnknownTime) {
+            t.Errorf("ResolveTime(%q) = %s, %v, want ErrUnknownTime", value, got, err)
+        }
+    }
+}
+
+func TestNormalizeTime(t *testing.T) {
+    tests := []struct {
+        value string
+        want  string
+    }{
+        {"-7d", "-7d"},
+        {" now ", "now"},
+        {"1700000000", "1700000000"},
+        {"2023-11-14T22:13:20Z", "1700000000"},
+        {"midnight", "midnight"},
+        {" 16:00_20240102", "16:00_20240102"},
+        {"-1d2h", "-1d2h"},
+    }
+
+    for _, tt := range tests {
+        if got, err := NormalizeTime(tt.value); err != nil || got != tt.want {
+            t.Errorf("NormalizeTime(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+        }
+    }
+}
+
+func TestValidateRange(t *testing.T) {
+    now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        from    string
+        until   string
+        wantErr string
+    }{
+        {"-7d", "now", ""},
+        {"1700000000", "-1h", ""},
+        {"-1h", "-7d", `from "-1h" (2024-01-10T11:00:00Z) is not before until "-7d" (2024-01-03T12:00:00Z)`},
+        {"now", "now", "is not before"},
+        {"-1q", "now", `invalid time "-1q"`},
+        {"midnight", "now", ""},
+        {"-1h", "yesterday", ""},
+    }
+
+    for _, tt := range tests {
+        err := ValidateRange(tt.from, tt.until, now)
+        if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+            t.Errorf("ValidateRange(%q, %q) = %v, want an error containing %q", tt.from, tt.until, err, tt.wantErr)
+        }
+    }
+}
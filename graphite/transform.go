@@ -0,0 +1,164 @@
+package graphite
+
+import (
+    "sort"
+    "time"
+)
+
+// Statistics SlidingWindow can compute over each window.
+const (
+    WindowAverage = "average"
+    WindowSum     = "sum"
+)
+
+// Derivative replaces every series with the differences between its
+// successive non-null datapoints, each stamped with the later point's
+// timestamp. With clampResets, negative deltas (counter resets) become 0.
+func Derivative(dataPoints []DataPoint, clampResets bool) []DataPoint {
+    derived := make([]DataPoint, len(dataPoints))
+
+    for i, dp := range dataPoints {
+        derived[i] = DataPoint{Target: dp.Target, Tags: dp.Tags}
+
+        var previous float64
+        var havePrevious bool
+        for _, point := range dp.DataPoints {
+            value, ok := pointValue(point)
+            if !ok {
+                continue
+            }
+
+            if havePrevious {
+                delta := value - previous
+                if clampResets && delta < 0 {
+                    delta = 0
+                }
+                derived[i].DataPoints = append(derived[i].DataPoints, []*float64{&delta, timestampOf(point)})
+            }
+            previous = value
+            havePrevious = true
+        }
+    }
+
+    return derived
+}
+
+func timestampOf(point []*float64) *float64 {
+    if len(point) < 2 {
+        return nil
+    }
+
+    return point[1]
+}
+
+// Rollups computes statistics separately for each bucket of the given
+// size, keyed by the Unix time at which the bucket starts. Buckets are
+// aligned to the Unix epoch, so one-day buckets start at midnight UTC.
+// Buckets without any usable datapoint are left out.
+func Rollups(dataPoints []DataPoint, size time.Duration, opts StatsOptions) map[int64]MetricStatistics {
+    seconds := int64(size / time.Second)
+    buckets := map[int64][]DataPoint{}
+
+    for _, dp := range dataPoints {
+        // index locates this series within each bucket it contributes to.
+        index := map[int64]int{}
+        for _, point := range dp.DataPoints {
+            timestamp := pointTimestamp(point)
+            start := timestamp - timestamp%seconds
+
+            i, ok := index[start]
+            if !ok {
+                i = len(buckets[start])
+                index[start] = i
+                buckets[start] = append(buckets[start], DataPoint{Target: dp.Target, Tags: dp.Tags})
+            }
+            buckets[start][i].DataPoints = append(buckets[start][i].DataPoints, point)
+        }
+    }
+
+    rollups := make(map[int64]MetricStatistics, len(buckets))
+    for start, bucket := range buckets {
+        stats, err := CalculateStatistics(bucket, opts)
+        if err != nil {
+            continue
+        }
+        rollups[start] = stats
+    }
+
+    return rollups
+}
+
+// WindowStatistics reports the extremes of a statistic computed over every
+// sliding window of Size seconds; HighestEnd and LowestEnd are the Unix
+// times at which those windows end.
+type WindowStatistics struct {
+    Size       int64   `json:"size"`
+    Statistic  string  `json:"statistic"`
+    Windows    int     `json:"windows"`
+    Highest    float64 `json:"highest"`
+    HighestEnd int64   `json:"highest_end"`
+    Lowest     float64 `json:"lowest"`
+    LowestEnd  int64   `json:"lowest_end"`
+}
+
+// SlidingWindow computes statistic, WindowAverage or WindowSum, over the
+// non-null datapoints of every window (end-size, end] that ends at a
+// datapoint, across all series. Only windows lying entirely after the
+// first datapoint are considered, so that a partly covered window at the
+// start of the range cannot be the extreme. It returns nil when the data
+// spans less than one window.
+func SlidingWindow(dataPoints []DataPoint, size time.Duration, statistic string) *WindowStatistics {
+    type sample struct {
+        timestamp int64
+        value     float64
+    }
+
+    var samples []sample
+    for _, dp := range dataPoints {
+        for _, point := range dp.DataPoints {
+            if len(point) < 2 {
+                continue
+            }
+            if value, ok := pointValue(point); ok {
+                samples = append(samples, sample{pointTimestamp(point), value})
+            }
+        }
+    }
+    sort.SliceStable(samples, func(i, j int) bool { return samples[i].timestamp < samples[j].timestamp })
+
+    seconds := int64(size / time.Second)
+    var window *WindowStatistics
+    var sum float64
+    start := 0
+    for end, s := range samples {
+        sum += s.value
+        for samples[start].timestamp <= s.timestamp-seconds {
+            sum -= samples[start].value
+            start++
+        }
+        // Evaluate each window once, after its last datapoint.
+        if end+1 < len(samples) && samples[end+1].timestamp == s.timestamp {
+            continue
+        }
+        if s.timestamp-seconds < samples[0].timestamp {
+            continue
+        }
+
+        value := sum
+        if statistic == WindowAverage {
+            value = sum / float64(end-start+1)
+        }
+        if window == nil {
+            window = &WindowStatistics{Size: seconds, Statistic: statistic, Highest: value, HighestEnd: s.timestamp, Lowest: value, LowestEnd: s.timestamp}
+        }
+        window.Windows++
+        if value > window.Highest {
+            window.Highest, window.HighestEnd = value, s.timestamp
+        }
+        if value < window.Lowest {
+            window.Lowest, window.LowestEnd = value, s.timestamp
+        }
+    }
+
+    return window
+}
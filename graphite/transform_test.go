@@ -0,0 +1,126 @@
+package graphite
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+// pairs flattens the first series of dataPoints into [value, timestamp]
+// pairs, skipping nulls.
+func pairs(dataPoints []DataPoint) [][2]float64 {
+    var got [][2]float64
+    for _, point := range dataPoints[0].DataPoints {
+        if point[0] != nil {
+            got = append(got, [2]float64{*point[0], *point[1]})
+        }
+    }
+
+    return got
+}
+
+func TestDerivative(t *testing.T) {
+    tests := []struct {
+        name        string
+        data        []DataPoint
+        clampResets bool
+        want        [][2]float64
+    }{
+        {"monotonic", floats(10, 15, 25), false, [][2]float64{{5, 2}, {10, 3}}},
+        {"null gap", series(ptr(10), nil, ptr(16)), false, [][2]float64{{6, 3}}},
+        {"counter reset", floats(10, 40, 5, 20), false, [][2]float64{{30, 2}, {-35, 3}, {15, 4}}},
+        {"counter reset clamped", floats(10, 40, 5, 20), true, [][2]float64{{30, 2}, {0, 3}, {15, 4}}},
+        {"single point", floats(10), false, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := pairs(Derivative(tt.data, tt.clampResets)); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Derivative = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRollups(t *testing.T) {
+    const day = 86400
+    start := float64(19000 * day)
+    data := timed(
+        [2]float64{1, start},
+        [2]float64{3, start + 23*3600},
+        [2]float64{10, start + day},
+        [2]float64{20, start + day + 3600},
+        [2]float64{30, start + day + 7200},
+    )
+
+    rollups := Rollups(data, 24*time.Hour, StatsOptions{})
+
+    if len(rollups) != 2 {
+        t.Fatalf("got %d buckets, want 2: %v", len(rollups), rollups)
+    }
+    first, second := rollups[int64(start)], rollups[int64(start)+day]
+    if first.Count != 2 || first.Average != 2 || first.Maximum != 3 {
+        t.Errorf("first day = count %d, average %v, max %v, want 2, 2, 3", first.Count, first.Average, first.Maximum)
+    }
+    if second.Count != 3 || second.Average != 20 || second.Minimum != 10 {
+        t.Errorf("second day = count %d, average %v, min %v, want 3, 20, 10", second.Count, second.Average, second.Minimum)
+    }
+}
+
+func TestRollupsSkipEmptyBuckets(t *testing.T) {
+    data := series(ptr(1), nil)
+    data[0].DataPoints[1][1] = ptr(7200)
+
+    rollups := Rollups(data, time.Hour, StatsOptions{})
+    if len(rollups) != 1 {
+        t.Errorf("Rollups = %v, want only the bucket with a value", rollups)
+    }
+}
+
+// minutely is a series of values one minute apart from timestamp 0.
+func minutely(values ...float64) []DataPoint {
+    var points [][2]float64
+    for i, v := range values {
+        points = append(points, [2]float64{v, float64(60 * i)})
+    }
+
+    return timed(points...)
+}
+
+func TestSlidingWindow(t *testing.T) {
+    // A three-minute burst of tens among ones.
+    burst := minutely(1, 1, 1, 1, 1, 1, 10, 10, 10, 1, 1)
+
+    tests := []struct {
+        name      string
+        data      []DataPoint
+        statistic string
+        want      *WindowStatistics
+    }{
+        // The windows ending at 300 through 600 average 1, 2.8, 4.6, 6.4,
+        // 6.4 and 6.4; the first of equal extremes is kept.
+        {"average", burst, WindowAverage, &WindowStatistics{Size: 300, Statistic: WindowAverage, Windows: 6, Highest: 6.4, HighestEnd: 480, Lowest: 1, LowestEnd: 300}},
+        {"sum", burst, WindowSum, &WindowStatistics{Size: 300, Statistic: WindowSum, Windows: 6, Highest: 32, HighestEnd: 480, Lowest: 5, LowestEnd: 300}},
+        {"shorter than a window", minutely(1, 2, 3), WindowAverage, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := SlidingWindow(tt.data, 5*time.Minute, tt.statistic)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("SlidingWindow = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestSlidingWindowSkipsNulls(t *testing.T) {
+    data := minutely(2, 2, 2, 2, 2, 8)
+    data[0].DataPoints[3][0] = nil
+
+    // The only window, ending at 300, holds 2, 2, 2 and 8.
+    got := SlidingWindow(data, 5*time.Minute, WindowAverage)
+    if got == nil || got.Windows != 1 || got.Highest != 3.5 {
+        t.Errorf("SlidingWindow = %+v, want one window averaging 3.5", got)
+    }
+}
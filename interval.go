@@ -0,0 +1,51 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "graphite/graphite"
+)
+
+// runEvery takes a snapshot every cfg.Interval until ctx is cancelled. A
+// failed snapshot is logged and the next one still runs. With -output,
+// every snapshot is written to its own timestamped file; otherwise they
+// follow each other on stdout.
+func runEvery(ctx context.Context, cfg Config, client graphite.Fetcher) {
+    ticker := time.NewTicker(cfg.Interval)
+    defer ticker.Stop()
+
+    for {
+        snapshot := cfg
+        if cfg.Output != "" {
+            snapshot.Output = snapshotPath(cfg.Output, time.Now())
+        }
+
+        failures, err := runSnapshot(ctx, snapshot, client)
+        if err != nil {
+            slog.Error("snapshot failed", "error", err)
+        } else if failures > 0 {
+            slog.Warn("some metrics could not be collected", "failures", failures)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// snapshotPath inserts the UTC time t before the extension of path, e.g.
+// stats.json becomes stats-20240102T150405Z.json and stats.json.gz
+// stats-20240102T150405Z.json.gz.
+func snapshotPath(path string, t time.Time) string {
+    ext := filepath.Ext(path)
+    if ext == ".gz" {
+        ext = filepath.Ext(strings.TrimSuffix(path, ext)) + ext
+    }
+    return strings.TrimSuffix(path, ext) + "-" + t.UTC().Format("20060102T150405Z") + ext
+}
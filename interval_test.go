@@ -0,0 +1,59 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestRunEvery(t *testing.T) {
+    dir := t.TempDir()
+    cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false", "-interval", "1s", "-output", filepath.Join(dir, "stats.json")})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+    defer cancel()
+    runEvery(ctx, cfg, memoryGraphite())
+
+    snapshots, err := filepath.Glob(filepath.Join(dir, "stats-*Z.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(snapshots) != 2 {
+        t.Fatalf("got snapshots %q, want 2 in 1.5s at a 1s interval", snapshots)
+    }
+    for _, path := range snapshots {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var out OutputFormat
+        if err := json.Unmarshal(data, &out); err != nil || out[0]["s1"]["cpu"].Count != 2 {
+            t.Errorf("%s = %s, %v, want the s1 statistics", path, data, err)
+        }
+    }
+}
+
+func TestSnapshotPath(t *testing.T) {
+    at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600))
+
+    tests := []struct {
+        path string
+        want string
+    }{
+        {"stats.json", "stats-20240102T140405Z.json"},
+        {"out/stats.json.gz", "out/stats-20240102T140405Z.json.gz"},
+        {"stats", "stats-20240102T140405Z"},
+    }
+
+    for _, tt := range tests {
+        if got := snapshotPath(tt.path, at); got != tt.want {
+            t.Errorf("snapshotPath(%q) = %q, want %q", tt.path, got, tt.want)
+        }
+    }
+}
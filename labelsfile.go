@@ -0,0 +1,37 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "regexp"
+)
+
+// labelName is the label names -labels-file accepts: those valid in the
+// Prometheus exposition format, which every output format can carry.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// readLabelsFile reads a JSON object mapping server names to objects of
+// string labels:
+//
+//	{"s1": {"team": "network", "dc": "ams1"}}
+func readLabelsFile(path string) (map[string]map[string]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var labels map[string]map[string]string
+    if err := json.Unmarshal(data, &labels); err != nil {
+        return nil, fmt.Errorf("%s: want an object of server labels: %v", path, err)
+    }
+    for server, serverLabels := range labels {
+        for name := range serverLabels {
+            if !labelName.MatchString(name) || name == "server" || name == "metric" {
+                return nil, fmt.Errorf("%s: invalid label %q for server %s", path, name, server)
+            }
+        }
+    }
+
+    return labels, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestLabelsFile(t *testing.T) {
+    labels := writeFile(t, "labels.json", `{"s1": {"team": "network", "dc": "ams1"}, "s3": {"team": "storage"}}`)
+    srv := newFakeGraphite(t, &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1", "base.s2"},
+            "base.s1.snmp.*": {"base.s1.snmp.cpu", "base.s1.snmp.mem"},
+            "base.s2.snmp.*": {"base.s2.snmp.cpu"},
+        },
+        render: map[string]string{"base.s1.snmp.cpu": "[[1, 100]]", "base.s1.snmp.mem": "[[2, 100]]", "base.s2.snmp.cpu": "[[3, 100]]"},
+    })
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-labels-file", labels, "-aggregate")
+
+    for _, entry := range out {
+        for server, stats := range entry {
+            for metric, s := range stats {
+                var want map[string]string
+                if server == "s1" {
+                    want = map[string]string{"team": "network", "dc": "ams1"}
+                }
+                // s2 has no labels, nor does the aggregate across servers.
+                if !reflect.DeepEqual(s.Labels, want) {
+                    t.Errorf("%s %s: labels = %v, want %v", server, metric, s.Labels, want)
+                }
+            }
+        }
+    }
+}
+
+func TestLabelsFileInvalid(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        wantErr string
+    }{
+        {"not an object", `["s1"]`, "want an object of server labels"},
+        {"numeric value", `{"s1": {"rack": 4}}`, "want an object of server labels"},
+        {"invalid name", `{"s1": {"data-center": "ams1"}}`, `invalid label "data-center" for server s1`},
+        {"reserved name", `{"s1": {"metric": "x"}}`, `invalid label "metric" for server s1`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := parseConfig([]string{"-labels-file", writeFile(t, "labels.json", tt.content)})
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestLabelsFileFormats(t *testing.T) {
+    labels := writeFile(t, "labels.json", `{"s1": {"team": "network", "dc": "ams1"}}`)
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1", "base.s2"},
+            "base.s1.snmp.*": {"base.s1.snmp.cpu"},
+            "base.s2.snmp.*": {"base.s2.snmp.cpu"},
+        },
+        render: map[string]string{"base.s1.snmp.cpu": "[[1, 100]]", "base.s2.snmp.cpu": "[[3, 100]]"},
+    }
+
+    tests := []struct {
+        format string
+        want   []string
+        // times is how often the s1 labels appear: once per metric, and
+        // in Prometheus once per sample of each of its five families.
+        times int
+    }{
+        {"json", []string{`"labels": {`, `"dc": "ams1"`, `"team": "network"`}, 1},
+        {"ndjson", []string{`{"server":"s1","metric":"cpu",`, `"labels":{"dc":"ams1","team":"network"}`}, 1},
+        {"csv", []string{"standard_deviation,label_dc,label_team\n", "s1,cpu,1,1,1,1,1,0,ams1,network\n", "s2,cpu,1,3,3,3,3,0,,\n"}, 1},
+        {"table", []string{"COUNT  DC    TEAM\n", "1      ams1  network\n"}, 1},
+        {"prometheus", []string{`graphite_metric_count{server="s1",metric="cpu",dc="ams1",team="network"} 1`, `graphite_metric_count{server="s2",metric="cpu"} 1`}, 5},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.format, func(t *testing.T) {
+            data, failures, err := run(t, newFakeGraphite(t, f).URL, "-base-dir", "base", "-labels-file", labels, "-format", tt.format)
+            if err != nil || failures != 0 {
+                t.Fatalf("run: %d failures, error %v", failures, err)
+            }
+            for _, want := range tt.want {
+                if !strings.Contains(data, want) {
+                    t.Errorf("output does not contain %q:\n%s", want, data)
+                }
+            }
+            // Only s1 is labelled.
+            if n := strings.Count(data, "network"); n != tt.times {
+                t.Errorf("labels appear %d times, want %d:\n%s", n, tt.times, data)
+            }
+        })
+    }
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+)
+
+// list writes the name of every discovered server, or with metrics the
+// path of every metric of every server, one per line. No datapoints are
+// fetched.
+func (p *pipeline) list(ctx context.Context, w io.Writer, metrics bool) error {
+    servers, metricsOf, err := p.discover(ctx)
+    if err != nil {
+        return err
+    }
+
+    bw := bufio.NewWriter(w)
+    for _, server := range servers {
+        if ctx.Err() != nil {
+            break
+        }
+        if !metrics {
+            fmt.Fprintln(bw, server)
+            continue
+        }
+
+        jobs, _ := metricsOf(ctx, server)
+        for _, job := range jobs {
+            fmt.Fprintln(bw, job.path)
+        }
+    }
+
+    return bw.Flush()
+}
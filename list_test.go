@@ -0,0 +1,47 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "testing"
+)
+
+func TestList(t *testing.T) {
+    tests := []struct {
+        name    string
+        metrics bool
+        want    string
+    }{
+        {"servers", false, "s1\n"},
+        {"metrics", true, "base.s1.snmp.cpu\nbase.s1.snmp.mem\n"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[2, 100]]"})
+            srv := newFakeGraphite(t, f)
+
+            cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false"})
+            if err != nil {
+                t.Fatal(err)
+            }
+            client, err := newGraphiteClient([]string{srv.URL}, cfg)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            var buf bytes.Buffer
+            p := &pipeline{cfg: cfg, client: client}
+            if err := p.list(context.Background(), &buf, tt.metrics); err != nil {
+                t.Fatal(err)
+            }
+
+            if buf.String() != tt.want {
+                t.Errorf("list = %q, want %q", buf.String(), tt.want)
+            }
+            if got := f.requested("/render"); len(got) != 0 {
+                t.Errorf("listing fetched datapoints: %q", got)
+            }
+        })
+    }
+}
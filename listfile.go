@@ -0,0 +1,29 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "strings"
+)
+
+// readListFile reads a newline-delimited list, ignoring blank lines and
+// lines starting with '#'.
+func readListFile(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var items []string
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        items = append(items, line)
+    }
+
+    return items, scanner.Err()
+}
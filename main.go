@@ -1,223 +1,812 @@
 package main
 
 import (
-    "encoding/json"
+    "bytes"
+    "context"
+    "errors"
+    "flag"
     "fmt"
     "io"
-    "math"
-    "net/http"
+    "log/slog"
     "os"
+    "os/signal"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "graphite/graphite"
+)
+
+type ServerStatistics map[string]graphite.MetricStatistics
+
+type OutputFormat []map[string]ServerStatistics
+
+const (
+    aggregateKey   = "_aggregate"
+    untaggedServer = "_untagged"
 )
 
+// Exit codes, see README.md.
 const (
-    baseDir = "telegraf.vsphere_metrics.oob.qa.dell"
-    metricsDir = "snmp"
+    exitOK      = 0
+    exitFatal   = 1
+    exitPartial = 2
 )
 
-type DataPoint struct {
-    Target     string      `json:"target"`
-    Tags       interface{} `json:"tags"`
-    DataPoints [][]float64 `json:"datapoints"`
+func newGraphiteClient(graphiteURLs []string, cfg Config) (*graphite.Client, error) {
+    httpClient, err := newHTTPClient(cfg)
+    if err != nil {
+        return nil, err
+    }
+
+    client := graphite.NewClient(graphiteURLs[0], httpClient)
+    client.Fallbacks = graphiteURLs[1:]
+    client.BaseDir = cfg.BaseDir
+    client.MetricsDir = cfg.MetricsDirs[0]
+    client.From = cfg.From
+    client.Until = cfg.Until
+    client.Retries = cfg.Retries
+    client.Rate = cfg.Rate
+    client.RenderFormat = cfg.RenderFormat
+    client.ValidateSchema = cfg.ValidateSchema
+    client.FindFormat = cfg.FindFormat
+    client.ChunkSize = time.Duration(cfg.ChunkDays) * 24 * time.Hour
+    client.TargetTemplate = cfg.TargetTemplate
+    client.MaxDataPoints = cfg.MaxDataPoints
+    client.ConsolidateBy = cfg.ConsolidateBy
+    client.NoNullPoints = cfg.NoNullPoints
+    client.Username = cfg.Username
+    client.Password = cfg.Password
+    client.Token = cfg.Token
+    client.UserAgent = userAgent()
+    client.Header = cfg.Headers
+    client.ServerQuery = cfg.ServerQuery
+    client.FullServerPaths = cfg.FullServerPaths
+    client.Include = cfg.Include
+    client.Exclude = cfg.Exclude
+    if cfg.MetricsAllowlist != "" {
+        paths, err := readListFile(cfg.MetricsAllowlist)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read metrics allowlist: %v", err)
+        }
+        client.Allowlist = make(map[string]bool, len(paths))
+        for _, path := range paths {
+            client.Allowlist[path] = true
+        }
+    }
+    if cfg.CacheDir != "" {
+        client.Cache = &graphite.DiskCache{Dir: cfg.CacheDir, TTL: cfg.CacheTTL}
+    }
+    if cfg.DryRun {
+        client.DryRun = os.Stdout
+    }
+
+    return client, nil
 }
 
-type MetricStatistics struct {
-    Count             int     `json:"count"`
-    Average           float64 `json:"average"`
-    Sum               float64 `json:"sum"`
-    Maximum           float64 `json:"maximum"`
-    Minimum           float64 `json:"minimum"`
-    StandardDeviation float64 `json:"standard_deviation"`
+// pipeline fetches and summarizes every metric of every server, counting
+// the fetches and parses that fail along the way.
+type pipeline struct {
+    cfg    Config
+    client graphite.Fetcher
+
+    // cancel stops the run on the first failure when cfg.FailFast is set.
+    cancel   context.CancelFunc
+    failures atomic.Int64
+    // failureLog holds the failures until reportFailures logs them.
+    failureLog failureLog
+
+    // progress is nil when progress reporting is disabled; it is set up
+    // once the number of servers is known.
+    progress *progressReporter
+
+    // slots bounds the Graphite requests in flight across all servers.
+    slots chan struct{}
+
+    // Totals reported by -summary. The client counts retries over its
+    // lifetime, so startRetries is its count when the run began.
+    servers      atomic.Int64
+    metrics      atomic.Int64
+    datapoints   atomic.Int64
+    startRetries int64
 }
 
-type ServerStatistics map[string]MetricStatistics
+// writeSummary writes the one-line -summary footer.
+func (p *pipeline) writeSummary(w io.Writer, elapsed time.Duration) {
+    fmt.Fprintf(w, "summary: %d servers, %d metrics, %d datapoints, %d errors, %d retries in %s\n",
+        p.servers.Load(), p.metrics.Load(), p.datapoints.Load(), p.failures.Load(), p.client.RetryCount()-p.startRetries, elapsed.Round(time.Millisecond))
+}
 
-type OutputFormat []map[string]ServerStatistics
+// reportFailures logs the failures collected since the last call, sorted
+// by server and metric.
+func (p *pipeline) reportFailures() {
+    p.failureLog.flush()
+}
+
+func (p *pipeline) fail(msg string, args ...any) {
+    p.failAt(slog.LevelError, msg, args...)
+}
 
-func fetchServerList(graphiteURL string) ([]string, error) {
-    url := fmt.Sprintf("%s/metrics/find?query=%s.*&format=json", graphiteURL, baseDir)
+func (p *pipeline) failAt(level slog.Level, msg string, args ...any) {
+    if !p.cfg.Quiet {
+        p.failureLog.add(level, msg, args...)
+    }
+    p.failures.Add(1)
+    if p.cfg.FailFast && p.cancel != nil {
+        p.cancel()
+    }
+}
 
-    resp, err := http.Get(url)
+// collect discovers servers, either hierarchically or through tag
+// queries, and writes the statistics of each to results.
+func (p *pipeline) collect(ctx context.Context, results resultWriter) error {
+    servers, metricsOf, err := p.discover(ctx)
     if err != nil {
-        return nil, fmt.Errorf("failed to fetch server list: %v", err)
+        return err
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+    return p.processServers(ctx, servers, metricsOf, results)
+}
+
+// discover returns the servers to process along with the function that
+// lists the metrics of each.
+func (p *pipeline) discover(ctx context.Context) ([]string, func(context.Context, string) ([]metricJob, bool), error) {
+    p.slots = make(chan struct{}, p.cfg.Concurrency)
+
+    if len(p.cfg.TagQueries) > 0 {
+        series, err := p.client.FindSeries(ctx, p.cfg.TagQueries)
+        if err != nil {
+            return nil, nil, fmt.Errorf("series discovery failed: %w", err)
+        }
+
+        servers, groups := p.groupTagged(series)
+        return servers, func(_ context.Context, server string) ([]metricJob, bool) {
+            return groups[server], true
+        }, nil
     }
 
-    body, err := io.ReadAll(resp.Body)
+    servers, err := serverList(ctx, p.client, p.cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to read response body: %v", err)
+        return nil, nil, fmt.Errorf("server discovery failed: %w", err)
     }
 
-    var servers []struct {
-        Path string `json:"path"`
+    return servers, p.discoverMetrics, nil
+}
+
+// groupTagged groups tagged series by the value of their cfg.TagServer
+// tag, each group then being processed as a server.
+func (p *pipeline) groupTagged(series []string) ([]string, map[string][]metricJob) {
+    var servers []string
+    groups := map[string][]metricJob{}
+
+    for _, s := range series {
+        name, tags := graphite.ParseTaggedSeries(s)
+        server, ok := tags[p.cfg.TagServer]
+        if !ok {
+            server = untaggedServer
+        }
+        if _, ok := groups[server]; !ok {
+            servers = append(servers, server)
+        }
+        groups[server] = append(groups[server], metricJob{path: s, key: metricKey(name, p.cfg.MetricKeySegments)})
     }
-    err = json.Unmarshal(body, &servers)
-    if err != nil {
-        return nil, fmt.Errorf("failed to parse JSON: %v", err)
+
+    return onlyServers(servers, p.cfg.OnlyServers), groups
+}
+
+func (p *pipeline) startProgress(total int) {
+    if p.cfg.Progress {
+        p.progress = newProgressReporter(os.Stderr, total)
     }
+}
 
-    var serverNames []string
-    for _, server := range servers {
-        parts := strings.Split(server.Path, ".")
-        serverNames = append(serverNames, parts[len(parts)-1])
+// processServers runs cfg.ServerConcurrency servers at a time. Every
+// Graphite request made on their behalf takes a slot from a single pool
+// of cfg.Concurrency, so running servers in parallel does not raise the
+// load on Graphite. Servers are still written in discovery order.
+func (p *pipeline) processServers(ctx context.Context, servers []string, discover func(context.Context, string) ([]metricJob, bool), results resultWriter) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    p.startProgress(len(servers))
+    out := newOrderedResults(results, servers, p.cfg.Aggregate)
+
+    var wg sync.WaitGroup
+    jobs := make(chan int)
+
+    for i := 0; i < p.cfg.ServerConcurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for i := range jobs {
+                if ctx.Err() != nil {
+                    out.skip(i)
+                    continue
+                }
+
+                metrics, ok := discover(ctx, servers[i])
+                if !ok {
+                    p.progress.serverDone()
+                    out.skip(i)
+                    continue
+                }
+
+                serverStats := p.processServer(ctx, servers[i], metrics)
+                if len(serverStats) == 0 && p.cfg.SkipEmptyServers {
+                    slog.Debug("server has no statistics, leaving it out", "server", servers[i])
+                    out.skip(i)
+                    continue
+                }
+                if err := out.complete(i, serverStats); err != nil {
+                    cancel()
+                }
+            }
+        }()
+    }
+
+feed:
+    for i := range servers {
+        select {
+        case jobs <- i:
+        case <-ctx.Done():
+            break feed
+        }
     }
+    close(jobs)
+    wg.Wait()
 
-    return serverNames, nil
+    return out.finish()
 }
 
-func fetchMetricsList(graphiteURL, server string) ([]string, error) {
-    url := fmt.Sprintf("%s/metrics/find?query=%s.%s.%s.*&format=json", graphiteURL, baseDir, server, metricsDir)
+func (p *pipeline) processServer(ctx context.Context, server string, metrics []metricJob) ServerStatistics {
+    if limit := p.cfg.MaxMetricsPerServer; limit > 0 && len(metrics) > limit {
+        slog.Warn("server exceeds -max-metrics-per-server, skipping the rest", "server", server, "limit", limit, "skipped", len(metrics)-limit)
+        metrics = metrics[:limit]
+    }
+    if len(metrics) == 0 {
+        if p.cfg.RequireMetrics {
+            p.fail("server has no metrics", "server", server)
+        } else {
+            slog.Warn("server has no metrics", "server", server)
+        }
+    }
 
-    resp, err := http.Get(url)
-    if err != nil {
-        return nil, fmt.Errorf("failed to fetch metrics list: %v", err)
+    serverStats := p.collectServerStats(ctx, metrics)
+    if labels := p.cfg.Labels[server]; labels != nil {
+        for key, stats := range serverStats {
+            stats.Labels = labels
+            serverStats[key] = stats
+        }
     }
-    defer resp.Body.Close()
+    p.progress.serverDone()
+    p.servers.Add(1)
 
-    if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+    return serverStats
+}
+
+// acquire takes a slot from the shared request pool, reporting false if
+// ctx is done first.
+func (p *pipeline) acquire(ctx context.Context) bool {
+    select {
+    case p.slots <- struct{}{}:
+        return true
+    case <-ctx.Done():
+        return false
     }
+}
 
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read response body: %v", err)
+func (p *pipeline) release() {
+    <-p.slots
+}
+
+// metricJob is a metric path to fetch along with the key its statistics
+// are stored under in ServerStatistics.
+type metricJob struct {
+    path string
+    key  string
+}
+
+// discoverMetrics lists the metrics of server across every metrics
+// directory. It reports false when discovery failed for all of them.
+func (p *pipeline) discoverMetrics(ctx context.Context, server string) ([]metricJob, bool) {
+    var jobs []metricJob
+    var failed int
+
+    for _, dir := range p.cfg.MetricsDirs {
+        if !p.acquire(ctx) {
+            return nil, false
+        }
+        metrics, err := p.client.MetricsListIn(ctx, server, dir)
+        p.release()
+        if err != nil {
+            p.fail("metric discovery failed", "server", server, "dir", dir, "error", err)
+            failed++
+            continue
+        }
+
+        for _, metric := range metrics {
+            key := metricKey(metric, p.cfg.MetricKeySegments)
+            if p.cfg.MetricKeySegments > 0 && len(p.cfg.MetricsDirs) > 1 && !strings.Contains("."+key+".", "."+dir+".") {
+                // Keys from different directories could collide; qualify
+                // them with the directory unless they already include it.
+                key = dir + "." + key
+            }
+            jobs = append(jobs, metricJob{path: metric, key: key})
+        }
     }
 
-    var metrics []struct {
-        Path string `json:"path"`
+    return jobs, failed < len(p.cfg.MetricsDirs)
+}
+
+// metricKey keeps the last segments dot-separated parts of path, or the
+// whole path when segments is 0.
+func metricKey(path string, segments int) string {
+    parts := strings.Split(path, ".")
+    if segments <= 0 || segments >= len(parts) {
+        return path
     }
-    err = json.Unmarshal(body, &metrics)
-    if err != nil {
-        return nil, fmt.Errorf("failed to parse JSON: %v", err)
+
+    return strings.Join(parts[len(parts)-segments:], ".")
+}
+
+// collectServerStats fetches metrics with cfg.Concurrency workers, which
+// share the request pool with every other server in flight, in batches
+// of cfg.BatchSize. Results are
+// applied in discovery order once all workers finish, so the output does
+// not depend on scheduling even when two metrics share a key.
+func (p *pipeline) collectServerStats(ctx context.Context, metrics []metricJob) ServerStatistics {
+    results := make([]*graphite.MetricStatistics, len(metrics))
+    batchSize := max(p.cfg.BatchSize, 1)
+
+    var wg sync.WaitGroup
+    jobs := make(chan int)
+
+    for i := 0; i < p.cfg.Concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for start := range jobs {
+                if batchSize > 1 {
+                    end := min(start+batchSize, len(metrics))
+                    p.fetchBatch(ctx, metrics[start:end], results[start:end])
+                    continue
+                }
+                if stats, ok := p.fetchMetric(ctx, metrics[start].path); ok {
+                    results[start] = &stats
+                }
+            }
+        }()
     }
 
-    var metricNames []string
-    for _, metric := range metrics {
-        metricNames = append(metricNames, metric.Path)
+feed:
+    for i := 0; i < len(metrics); i += batchSize {
+        select {
+        case jobs <- i:
+        case <-ctx.Done():
+            break feed
+        }
     }
+    close(jobs)
+    wg.Wait()
 
-    return metricNames, nil
+    serverStats := ServerStatistics{}
+    seen := map[string]string{}
+    for i, stats := range results {
+        if stats == nil {
+            continue
+        }
+
+        key := metrics[i].key
+        if previous, ok := seen[key]; ok {
+            p.failAt(slog.LevelWarn, "metric key collision, earlier statistics overwritten", "key", key, "metric", metrics[i].path, "overwritten", previous)
+        }
+        seen[key] = metrics[i].path
+        serverStats[key] = *stats
+    }
+
+    return serverStats
+}
+
+func (p *pipeline) fetchMetric(ctx context.Context, metric string) (graphite.MetricStatistics, bool) {
+    if !p.acquire(ctx) {
+        return graphite.MetricStatistics{}, false
+    }
+    dataPoints, err := p.fetchData(ctx, metric, p.cfg.From, p.cfg.Until)
+    var previous []graphite.DataPoint
+    if err == nil && p.cfg.comparing() {
+        previous, err = p.fetchData(ctx, metric, p.cfg.CompareFrom, p.cfg.CompareUntil)
+    }
+    p.release()
+    if err != nil {
+        p.fail("fetch failed", "metric", metric, "error", err)
+        return graphite.MetricStatistics{}, false
+    }
+
+    return p.metricStats(metric, dataPoints, previous)
 }
 
-func fetchData(graphiteURL, metric string) (string, error) {
-    url := fmt.Sprintf("%s/render?target=%s&from=-7d&format=json", graphiteURL, metric)
+// fetchBatch fetches jobs with a single request and stores the statistics
+// of each in the matching element of results.
+func (p *pipeline) fetchBatch(ctx context.Context, jobs []metricJob, results []*graphite.MetricStatistics) {
+    metrics := make([]string, len(jobs))
+    for i, job := range jobs {
+        metrics[i] = job.path
+    }
 
-    resp, err := http.Get(url)
+    if !p.acquire(ctx) {
+        return
+    }
+    batch, err := p.fetchBatchData(ctx, metrics, p.cfg.From, p.cfg.Until)
+    var previous map[string][]graphite.DataPoint
+    if err == nil && p.cfg.comparing() {
+        previous, err = p.fetchBatchData(ctx, metrics, p.cfg.CompareFrom, p.cfg.CompareUntil)
+    }
+    p.release()
     if err != nil {
-        return "", fmt.Errorf("failed to fetch data: %v", err)
+        p.fail("batch fetch failed", "metrics", len(metrics), "first", metrics[0], "error", err)
+        return
+    }
+
+    for i, metric := range metrics {
+        if stats, ok := p.metricStats(metric, batch[metric], previous[metric]); ok {
+            results[i] = &stats
+        }
+    }
+}
+
+// metricStats computes the statistics of metric from its fetched
+// datapoints, counting a failure when there are none to summarize. With
+// -compare-from, previous holds the datapoints of the comparison window.
+func (p *pipeline) metricStats(metric string, dataPoints, previous []graphite.DataPoint) (graphite.MetricStatistics, bool) {
+    if p.cfg.DryRun {
+        return graphite.MetricStatistics{}, false
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+    if p.cfg.Derivative {
+        dataPoints = graphite.Derivative(dataPoints, p.cfg.CounterReset)
     }
 
-    body, err := io.ReadAll(resp.Body)
+    stats, err := graphite.CalculateStatistics(dataPoints, p.cfg.statsOptions())
+    if errors.Is(err, graphite.ErrNoData) {
+        switch p.cfg.NoData {
+        case noDataSkip:
+            slog.Warn("metric has no data, skipping", "metric", metric)
+            return graphite.MetricStatistics{}, false
+        case noDataZero:
+            err = nil
+        }
+    }
     if err != nil {
-        return "", fmt.Errorf("failed to read response body: %v", err)
+        p.fail("statistics failed", "metric", metric, "error", err)
+        return graphite.MetricStatistics{}, false
     }
+    if p.cfg.Bucket > 0 {
+        // Every bucket repeats datapoints the metric already lists.
+        opts := p.cfg.statsOptions()
+        opts.IncludeDataPoints = false
+        stats.Rollups = graphite.Rollups(dataPoints, p.cfg.Bucket, opts)
+    }
+    if p.cfg.Window > 0 {
+        stats.Window = graphite.SlidingWindow(dataPoints, p.cfg.Window, p.cfg.WindowStat)
+    }
+    if p.cfg.comparing() {
+        stats.Delta = p.compareStats(metric, stats, previous)
+    }
+    slog.Debug("parsed datapoints", "metric", metric, "count", stats.Count)
+    p.metrics.Add(1)
+    p.datapoints.Add(int64(stats.Count))
 
-    return string(body), nil
+    return stats, true
 }
 
-func calculateStatistics(data string) (MetricStatistics, error) {
-    var dataPoints []DataPoint
-    err := json.Unmarshal([]byte(data), &dataPoints)
+// compareStats returns the change of stats since the comparison window,
+// or nil when the metric had no data in that window.
+func (p *pipeline) compareStats(metric string, stats graphite.MetricStatistics, previous []graphite.DataPoint) *graphite.Delta {
+    if p.cfg.Derivative {
+        previous = graphite.Derivative(previous, p.cfg.CounterReset)
+    }
+
+    previousStats, err := graphite.CalculateStatistics(previous, graphite.StatsOptions{SampleStdDev: p.cfg.SampleStdDev, Strict: p.cfg.Strict})
+    if errors.Is(err, graphite.ErrNoData) {
+        slog.Debug("metric has no data in the comparison window", "metric", metric)
+        return nil
+    }
     if err != nil {
-        return MetricStatistics{}, fmt.Errorf("failed to parse JSON: %v", err)
+        p.fail("comparison statistics failed", "metric", metric, "error", err)
+        return nil
     }
 
-    var sum, max, min, sumOfSquares float64
-    var count int
+    return graphite.CompareStatistics(stats, previousStats)
+}
 
-    for _, dp := range dataPoints {
-        for _, point := range dp.DataPoints {
-            value := point[0]
-            sum += value
-            sumOfSquares += value * value
-            if count == 0 || value > max {
-                max = value
-            }
-            if count == 0 || value < min {
-                min = value
-            }
-            count++
+// fetchData fetches metric over [from, until] within cfg.MetricTimeout,
+// when set, so that a single slow metric cannot hold up the others. The
+// timeout covers every retry and chunk of the window.
+func (p *pipeline) fetchData(ctx context.Context, metric, from, until string) ([]graphite.DataPoint, error) {
+    if p.cfg.MetricTimeout <= 0 {
+        return p.client.DataIn(ctx, metric, from, until)
+    }
+
+    metricCtx, cancel := context.WithTimeout(ctx, p.cfg.MetricTimeout)
+    defer cancel()
+
+    dataPoints, err := p.client.DataIn(metricCtx, metric, from, until)
+    if err != nil && ctx.Err() == nil && errors.Is(metricCtx.Err(), context.DeadlineExceeded) {
+        return nil, fmt.Errorf("metric timed out after %s: %w", p.cfg.MetricTimeout, err)
+    }
+
+    return dataPoints, err
+}
+
+// fetchBatchData is fetchData for a batch of metrics; cfg.MetricTimeout
+// then applies to the batch as a whole.
+func (p *pipeline) fetchBatchData(ctx context.Context, metrics []string, from, until string) (map[string][]graphite.DataPoint, error) {
+    if p.cfg.MetricTimeout <= 0 {
+        return p.client.DataBatchIn(ctx, metrics, from, until)
+    }
+
+    batchCtx, cancel := context.WithTimeout(ctx, p.cfg.MetricTimeout)
+    defer cancel()
+
+    batch, err := p.client.DataBatchIn(batchCtx, metrics, from, until)
+    if err != nil && ctx.Err() == nil && errors.Is(batchCtx.Err(), context.DeadlineExceeded) {
+        return nil, fmt.Errorf("batch timed out after %s: %w", p.cfg.MetricTimeout, err)
+    }
+
+    return batch, err
+}
+
+func serverList(ctx context.Context, client graphite.Fetcher, cfg Config) ([]string, error) {
+    if cfg.ServersFile == "" {
+        servers, err := client.ServerList(ctx)
+        if err != nil {
+            return nil, err
         }
+
+        return onlyServers(servers, cfg.OnlyServers), nil
     }
 
-    if count == 0 {
-        return MetricStatistics{}, fmt.Errorf("no data points found")
+    servers, err := readListFile(cfg.ServersFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read servers file: %v", err)
+    }
+
+    return onlyServers(servers, cfg.OnlyServers), nil
+}
+
+// onlyServers keeps the servers named in only, in their discovery order,
+// warning about names that were not discovered. An empty only keeps every
+// server.
+func onlyServers(servers, only []string) []string {
+    if len(only) == 0 {
+        return servers
+    }
+
+    wanted := map[string]bool{}
+    for _, server := range only {
+        wanted[server] = true
     }
 
-    average := sum / float64(count)
-    variance := (sumOfSquares / float64(count)) - (average * average)
-    stddev := math.Sqrt(variance)
+    var kept []string
+    found := map[string]bool{}
+    for _, server := range servers {
+        if wanted[server] {
+            kept = append(kept, server)
+            found[server] = true
+        }
+    }
+    for _, server := range only {
+        if !found[server] {
+            slog.Warn("server from -only-servers was not discovered", "server", server)
+            found[server] = true
+        }
+    }
 
-    return MetricStatistics{
-        Count:             count,
-        Average:           average,
-        Sum:               sum,
-        Maximum:           max,
-        Minimum:           min,
-        StandardDeviation: stddev,
-    }, nil
+    return kept
 }
 
-func main() {
-    graphiteURL := os.Getenv("GRAPHITE_URL")
-    if graphiteURL == "" {
-        fmt.Fprintf(os.Stderr, "Error: GRAPHITE_URL environment variable is not set\n")
-        os.Exit(1)
+func aggregateServer(aggregate, serverStats ServerStatistics) {
+    for metric, stats := range serverStats {
+        aggregate[metric] = graphite.Aggregate(aggregate[metric], stats)
     }
+}
 
-    servers, err := fetchServerList(graphiteURL)
+func main() {
+    cfg, err := parseConfig(os.Args[1:])
     if err != nil {
+        if err == flag.ErrHelp {
+            os.Exit(exitOK)
+        }
         fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-        os.Exit(1)
+        os.Exit(exitFatal)
     }
 
-    var output OutputFormat
+    if cfg.Version {
+        printVersion(os.Stdout)
+        os.Exit(exitOK)
+    }
 
-    for _, server := range servers {
-        metrics, err := fetchMetricsList(graphiteURL, server)
+    slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    if cfg.GraphiteURL == "" {
+        slog.Error("Graphite URL is not set: use -graphite-url or the " + graphiteURLEnv + " environment variable")
+        os.Exit(exitFatal)
+    }
+    graphiteURLs, err := normalizeBaseURLs(cfg.GraphiteURL)
+    if err != nil {
+        slog.Error("invalid Graphite URL", "error", err)
+        os.Exit(exitFatal)
+    }
+
+    if cfg.Check {
+        if err := check(ctx, graphiteURLs, cfg, os.Stdout); err != nil {
+            slog.Error("check failed", "error", err)
+            os.Exit(exitFatal)
+        }
+        return
+    }
+
+    client, err := newGraphiteClient(graphiteURLs, cfg)
+    if err != nil {
+        slog.Error("failed to configure Graphite client", "error", err)
+        os.Exit(exitFatal)
+    }
+
+    if cfg.Serve != "" {
+        if err := serve(ctx, cfg, client); err != nil {
+            slog.Error("server failed", "error", err)
+            os.Exit(exitFatal)
+        }
+        return
+    }
+
+    if cfg.ListServers || cfg.ListMetrics {
+        out, err := openOutput(cfg)
         if err != nil {
-            fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-            continue
+            slog.Error("failed to open output", "error", err)
+            os.Exit(exitFatal)
         }
 
-        serverStats := ServerStatistics{}
+        p := &pipeline{cfg: cfg, client: client}
+        err = p.list(ctx, out, cfg.ListMetrics)
+        p.reportFailures()
+        if closeErr := out.Close(); err == nil {
+            err = closeErr
+        }
+        if err != nil {
+            slog.Error("listing failed", "error", err)
+            os.Exit(exitFatal)
+        }
+        if p.failures.Load() > 0 {
+            os.Exit(exitPartial)
+        }
+        return
+    }
 
-        for _, metric := range metrics {
-            data, err := fetchData(graphiteURL, metric)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-                continue
-            }
+    if cfg.Interval > 0 {
+        runEvery(ctx, cfg, client)
+        return
+    }
 
-            stats, err := calculateStatistics(data)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-                continue
-            }
+    failures, err := runSnapshot(ctx, cfg, client)
+    if err != nil {
+        slog.Error("run failed", "error", err)
+        os.Exit(exitFatal)
+    }
 
-            parts := strings.Split(metric, ".")
-            metricName := parts[len(parts)-1]
+    if failures > 0 {
+        if cfg.Quiet {
+            slog.Warn(fmt.Sprintf("%d errors suppressed", failures))
+        } else {
+            slog.Warn("some metrics could not be collected", "failures", failures)
+        }
+        os.Exit(exitPartial)
+    }
+}
 
-            serverStats[metricName] = stats
+// runSnapshot runs the pipeline once and writes its results to the
+// configured output, returning the number of failures. An error means no
+// usable output was produced. With -state-file, the run starts where the
+// last one ended and, if it collected everything, records where it ended;
+// when the last one already reached -until, there is nothing to do.
+func runSnapshot(ctx context.Context, cfg Config, client graphite.Fetcher) (int64, error) {
+    if cfg.StateFile != "" {
+        var err error
+        cfg.From, cfg.Until, err = incrementalRange(cfg, time.Now())
+        if errors.Is(err, errNothingNew) {
+            // Not a failure: the output and the state file are left as
+            // they are for the next run to pick up from.
+            slog.Info("nothing new since the last run, skipping", "state_file", cfg.StateFile)
+            return 0, nil
         }
+        if err != nil {
+            return 0, err
+        }
+        slog.Debug("incremental run", "from", cfg.From, "until", cfg.Until)
+    }
+
+    // With -fail-fast, streaming formats would already have written part of
+    // the output by the time a failure aborts the run, so results are held
+    // back and the output is only opened once the run has succeeded. A dry
+    // run produces no results and leaves the output alone.
+    var pending bytes.Buffer
+    var out io.WriteCloser = nopWriteCloser{&pending}
+    var results resultWriter = discardWriter{}
+    if !cfg.DryRun {
+        if !cfg.FailFast {
+            var err error
+            if out, err = openOutput(cfg); err != nil {
+                return 0, err
+            }
+        }
+        results = newResultWriter(out, cfg)
+    }
 
-        output = append(output, map[string]ServerStatistics{server: serverStats})
+    runCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    if cfg.Deadline > 0 {
+        var cancelDeadline context.CancelFunc
+        runCtx, cancelDeadline = context.WithTimeout(runCtx, cfg.Deadline)
+        defer cancelDeadline()
     }
 
-    jsonOutput, err := json.MarshalIndent(output, "", "  ")
+    start := time.Now()
+    p := &pipeline{cfg: cfg, client: client, cancel: cancel, startRetries: client.RetryCount()}
+    err := p.collect(runCtx, results)
+    p.reportFailures()
     if err != nil {
-        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-        os.Exit(1)
+        out.Close()
+        return 0, err
+    }
+
+    failures := p.failures.Load()
+    if cfg.FailFast && failures > 0 {
+        out.Close()
+        return failures, errors.New("aborting after first failure")
+    }
+
+    if ctx.Err() != nil {
+        slog.Warn("run interrupted, printing partial results")
+    } else if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+        slog.Warn("deadline exceeded, printing partial results", "deadline", cfg.Deadline)
+    }
+
+    if err := results.Close(); err != nil {
+        out.Close()
+        return 0, fmt.Errorf("failed to write output: %w", err)
+    }
+
+    if err := out.Close(); err != nil {
+        return 0, fmt.Errorf("failed to write output: %w", err)
+    }
+
+    if cfg.FailFast && !cfg.DryRun {
+        if err := writePending(cfg, pending.Bytes()); err != nil {
+            return 0, err
+        }
+    }
+
+    if cfg.Summary {
+        p.writeSummary(os.Stderr, time.Since(start))
+    }
+
+    if cfg.StateFile != "" && !cfg.DryRun {
+        if failures > 0 || runCtx.Err() != nil {
+            slog.Warn("run incomplete, not advancing the state file", "state_file", cfg.StateFile)
+        } else {
+            until, _ := strconv.ParseInt(cfg.Until, 10, 64)
+            if err := writeState(cfg.StateFile, runState{Until: until}); err != nil {
+                return failures, fmt.Errorf("failed to write state file: %w", err)
+            }
+        }
     }
 
-    fmt.Println(string(jsonOutput))
+    return failures, nil
 }
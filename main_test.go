@@ -0,0 +1,1431 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "graphite/graphite"
+)
+
+// fakeGraphite is a Graphite stub. find maps a /metrics/find query to the
+// paths it matches, tagged is the answer to any /tags/findSeries query and
+// render maps a /render target to its datapoints, as JSON. Every request
+// URL is recorded.
+type fakeGraphite struct {
+    find   map[string][]string
+    tagged []string
+    render map[string]string
+
+    mu       sync.Mutex
+    requests []string
+}
+
+func (f *fakeGraphite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    f.mu.Lock()
+    f.requests = append(f.requests, r.URL.RequestURI())
+    f.mu.Unlock()
+
+    switch r.URL.Path {
+    case "/metrics/find":
+        nodes := []map[string]string{}
+        for _, path := range f.find[r.Form.Get("query")] {
+            nodes = append(nodes, map[string]string{"path": path})
+        }
+        json.NewEncoder(w).Encode(nodes)
+    case "/tags/findSeries":
+        json.NewEncoder(w).Encode(append([]string{}, f.tagged...))
+    case "/render":
+        var series []string
+        for _, target := range r.Form["target"] {
+            if datapoints, ok := f.render[target]; ok {
+                series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": %s}`, target, datapoints))
+            }
+        }
+        fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// requested returns the recorded requests whose path is path.
+func (f *fakeGraphite) requested(path string) []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    var requests []string
+    for _, r := range f.requests {
+        if strings.HasPrefix(r, path+"?") || r == path {
+            requests = append(requests, r)
+        }
+    }
+
+    return requests
+}
+
+func newFakeGraphite(t *testing.T, f *fakeGraphite) *httptest.Server {
+    t.Helper()
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+
+    return srv
+}
+
+// run takes a snapshot of the Graphite at url with the flags in args and
+// returns the output written, the number of failures and the run error.
+func run(t *testing.T, url string, args ...string) (string, int64, error) {
+    t.Helper()
+    output := filepath.Join(t.TempDir(), "out")
+
+    cfg, err := parseConfig(append([]string{"-graphite-url", url, "-progress=false", "-output", output}, args...))
+    if err != nil {
+        t.Fatalf("parseConfig: %v", err)
+    }
+    urls, err := normalizeBaseURLs(cfg.GraphiteURL)
+    if err != nil {
+        t.Fatalf("normalizeBaseURLs: %v", err)
+    }
+    client, err := newGraphiteClient(urls, cfg)
+    if err != nil {
+        t.Fatalf("newGraphiteClient: %v", err)
+    }
+
+    failures, err := runSnapshot(context.Background(), cfg, client)
+    data, _ := os.ReadFile(output)
+
+    return string(data), failures, err
+}
+
+// runJSON is like run for a JSON run that must succeed, decoding its output.
+func runJSON(t *testing.T, url string, args ...string) OutputFormat {
+    t.Helper()
+
+    data, failures, err := run(t, url, args...)
+    if err != nil || failures != 0 {
+        t.Fatalf("run: %d failures, error %v", failures, err)
+    }
+    var out OutputFormat
+    if err := json.Unmarshal([]byte(data), &out); err != nil {
+        t.Fatalf("invalid JSON output %q: %v", data, err)
+    }
+
+    return out
+}
+
+func TestBaseDirFlag(t *testing.T) {
+    tests := []struct {
+        name      string
+        args      []string
+        wantQuery string
+    }{
+        {"default", nil, "/metrics/find?query=telegraf.vsphere_metrics.oob.qa.dell.*&format=json"},
+        {"custom", []string{"-base-dir", "foo.bar"}, "/metrics/find?query=foo.bar.*&format=json"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := &fakeGraphite{}
+            srv := newFakeGraphite(t, f)
+
+            runJSON(t, srv.URL, tt.args...)
+
+            got := f.requested("/metrics/find")
+            if len(got) != 1 || got[0] != tt.wantQuery {
+                t.Errorf("find requests = %q, want [%q]", got, tt.wantQuery)
+            }
+        })
+    }
+}
+
+func TestMetricsDirFlag(t *testing.T) {
+    f := &fakeGraphite{find: map[string][]string{
+        "foo.*": {"foo.s1"},
+    }}
+    srv := newFakeGraphite(t, f)
+
+    runJSON(t, srv.URL, "-base-dir", "foo", "-metrics-dir", "cpu")
+
+    got := f.requested("/metrics/find")
+    want := "/metrics/find?query=foo.s1.cpu.*&format=json"
+    if len(got) != 2 || got[1] != want {
+        t.Errorf("find requests = %q, want the second to be %q", got, want)
+    }
+}
+
+// singleServer returns a fakeGraphite with one server, s1, whose snmp
+// metrics under the "base" base directory are the keys of series, mapped
+// to their datapoints.
+func singleServer(series map[string]string) *fakeGraphite {
+    f := &fakeGraphite{
+        find:   map[string][]string{"base.*": {"base.s1"}},
+        render: map[string]string{},
+    }
+    for name, datapoints := range series {
+        path := "base.s1.snmp." + name
+        f.find["base.s1.snmp.*"] = append(f.find["base.s1.snmp.*"], path)
+        f.render[path] = datapoints
+    }
+    sort.Strings(f.find["base.s1.snmp.*"])
+
+    return f
+}
+
+func TestTimeRangeFlags(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        want string
+    }{
+        {"default", nil, "&from=-7d&until=now&"},
+        {"relative", []string{"-from", "-1h", "-until", "-5min"}, "&from=-1h&until=-5min&"},
+        {"epochs", []string{"-from", "1700000000", "-until", "1700003600"}, "&from=1700000000&until=1700003600&"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := singleServer(map[string]string{"cpu": "[[1, 1700000000]]"})
+            srv := newFakeGraphite(t, f)
+
+            runJSON(t, srv.URL, append([]string{"-base-dir", "base"}, tt.args...)...)
+
+            got := f.requested("/render")
+            if len(got) != 1 || !strings.Contains(got[0], tt.want) {
+                t.Errorf("render requests = %q, want one containing %q", got, tt.want)
+            }
+        })
+    }
+}
+
+// inFlight wraps a handler, delaying each /render request by delay and
+// recording the largest number of them in flight at once.
+type inFlight struct {
+    handler http.Handler
+    delay   time.Duration
+
+    current atomic.Int64
+    max     atomic.Int64
+}
+
+func (f *inFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/render" {
+        n := f.current.Add(1)
+        defer f.current.Add(-1)
+        for {
+            if old := f.max.Load(); n <= old || f.max.CompareAndSwap(old, n) {
+                break
+            }
+        }
+        time.Sleep(f.delay)
+    }
+    f.handler.ServeHTTP(w, r)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+    series := map[string]string{}
+    for i := 0; i < 20; i++ {
+        series[fmt.Sprintf("m%02d", i)] = "[[1, 100]]"
+    }
+    limiter := &inFlight{handler: singleServer(series), delay: 20 * time.Millisecond}
+    srv := httptest.NewServer(limiter)
+    defer srv.Close()
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-concurrency", "3")
+
+    if got := len(out[0]["s1"]); got != 20 {
+        t.Errorf("got %d metrics, want 20", got)
+    }
+    if got := limiter.max.Load(); got > 3 {
+        t.Errorf("%d requests in flight, want at most 3", got)
+    }
+    if got := limiter.max.Load(); got < 2 {
+        t.Errorf("%d requests in flight, want metrics fetched concurrently", got)
+    }
+}
+
+func TestOutputFile(t *testing.T) {
+    f := singleServer(map[string]string{"cpu": "[[1, 100], [3, 200]]"})
+    srv := newFakeGraphite(t, f)
+
+    toFile, _, err := run(t, srv.URL, "-base-dir", "base")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Without -output the same JSON goes to stdout.
+    stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stdout.Close()
+    saved := os.Stdout
+    os.Stdout = stdout
+    defer func() { os.Stdout = saved }()
+
+    cfg, err := parseConfig([]string{"-graphite-url", srv.URL, "-base-dir", "base", "-progress=false"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    client, err := newGraphiteClient([]string{srv.URL}, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := runSnapshot(context.Background(), cfg, client); err != nil {
+        t.Fatal(err)
+    }
+    os.Stdout = saved
+
+    toStdout, err := os.ReadFile(stdout.Name())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if toFile != string(toStdout) {
+        t.Errorf("-output wrote:\n%s\nstdout got:\n%s", toFile, toStdout)
+    }
+
+    var out OutputFormat
+    if err := json.Unmarshal([]byte(toFile), &out); err != nil {
+        t.Fatalf("invalid JSON in -output file: %v", err)
+    }
+    if got := out[0]["s1"]["cpu"].Average; got != 2 {
+        t.Errorf("average = %v, want 2", got)
+    }
+}
+
+// captureLogs sends the default logger's output, at debug level and up,
+// to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+    t.Helper()
+
+    var buf bytes.Buffer
+    saved := slog.Default()
+    slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+    t.Cleanup(func() { slog.SetDefault(saved) })
+
+    return &buf
+}
+
+// failing wraps a handler so that /render requests for any target in
+// targets fail with a 500.
+func failing(handler http.Handler, targets ...string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        for _, target := range r.Form["target"] {
+            for _, t := range targets {
+                if r.URL.Path == "/render" && target == t {
+                    http.Error(w, "boom", http.StatusInternalServerError)
+                    return
+                }
+            }
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+func TestFailureLogNamesMetric(t *testing.T) {
+    logs := captureLogs(t)
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[1, 100]]"})
+    srv := httptest.NewServer(failing(f, "base.s1.snmp.mem"))
+    defer srv.Close()
+
+    _, failures, err := run(t, srv.URL, "-base-dir", "base", "-retries", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if failures != 1 {
+        t.Errorf("failures = %d, want 1", failures)
+    }
+
+    for _, want := range []string{"level=ERROR", "metric=base.s1.snmp.mem", "500"} {
+        if !strings.Contains(logs.String(), want) {
+            t.Errorf("logs do not contain %q:\n%s", want, logs)
+        }
+    }
+}
+
+func TestLogLevelFlag(t *testing.T) {
+    tests := []struct {
+        value   string
+        want    slog.Level
+        wantErr bool
+    }{
+        {"debug", slog.LevelDebug, false},
+        {"warn", slog.LevelWarn, false},
+        {"loud", 0, true},
+    }
+
+    for _, tt := range tests {
+        cfg, err := parseConfig([]string{"-log-level", tt.value})
+        if (err != nil) != tt.wantErr {
+            t.Errorf("-log-level %s: error = %v, want error %t", tt.value, err, tt.wantErr)
+            continue
+        }
+        if err == nil && cfg.LogLevel != tt.want {
+            t.Errorf("-log-level %s: level = %v, want %v", tt.value, cfg.LogLevel, tt.want)
+        }
+    }
+}
+
+// captureStdout redirects os.Stdout to a file until the returned function
+// is called, which returns what was written.
+func captureStdout(t *testing.T) func() string {
+    t.Helper()
+    return capture(t, &os.Stdout)
+}
+
+// captureStderr is like captureStdout for os.Stderr.
+func captureStderr(t *testing.T) func() string {
+    t.Helper()
+    return capture(t, &os.Stderr)
+}
+
+func capture(t *testing.T, file **os.File) func() string {
+    t.Helper()
+
+    f, err := os.CreateTemp(t.TempDir(), "output")
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := *file
+    *file = f
+    t.Cleanup(func() { *file = saved })
+
+    return func() string {
+        *file = saved
+        f.Close()
+        data, err := os.ReadFile(f.Name())
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(data)
+    }
+}
+
+// writeFile writes content to name in a new temporary directory and
+// returns its path.
+func writeFile(t *testing.T, name, content string) string {
+    t.Helper()
+
+    path := filepath.Join(t.TempDir(), name)
+    if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    return path
+}
+
+func TestDryRun(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        want []string
+    }{
+        {"discovery", nil, []string{
+            "%s/render?target=base.s1.snmp.cpu&from=-7d&until=now&format=json",
+            "%s/render?target=base.s1.snmp.mem&from=-7d&until=now&format=json",
+        }},
+        {"servers file", []string{"-servers-file", writeFile(t, "servers", "s1\n")}, []string{
+            "%s/render?target=base.s1.snmp.cpu&from=-7d&until=now&format=json",
+            "%s/render?target=base.s1.snmp.mem&from=-7d&until=now&format=json",
+        }},
+        {"batch", []string{"-batch-size", "2"}, []string{
+            "POST %s/render?format=json&from=-7d&target=base.s1.snmp.cpu&target=base.s1.snmp.mem&until=now",
+        }},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[2, 100]]"})
+            srv := newFakeGraphite(t, f)
+            output := writeFile(t, "out", "previous results")
+
+            stdout := captureStdout(t)
+            _, failures, err := run(t, srv.URL, append([]string{"-base-dir", "base", "-dry-run", "-output", output}, tt.args...)...)
+            printed := stdout()
+
+            if err != nil || failures != 0 {
+                t.Fatalf("run: %d failures, error %v", failures, err)
+            }
+            if got := f.requested("/render"); len(got) != 0 {
+                t.Errorf("render requests = %q, want none", got)
+            }
+            // Metrics are fetched concurrently, so the URLs come in any order.
+            got := strings.Split(strings.TrimSuffix(printed, "\n"), "\n")
+            sort.Strings(got)
+            var want []string
+            for _, line := range tt.want {
+                want = append(want, fmt.Sprintf(line, srv.URL))
+            }
+            if !slices.Equal(got, want) {
+                t.Errorf("printed %q, want %q", got, want)
+            }
+            if data, err := os.ReadFile(output); err != nil || string(data) != "previous results" {
+                t.Errorf("output file = %q, %v, want it left alone", data, err)
+            }
+        })
+    }
+}
+
+func TestServerQueryDepth(t *testing.T) {
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*.*":           {"base.dc1.s1", "base.dc2.s2"},
+            "base.dc1.s1.snmp.*": {"base.dc1.s1.snmp.cpu"},
+            "base.dc2.s2.snmp.*": {"base.dc2.s2.snmp.cpu"},
+        },
+        render: map[string]string{
+            "base.dc1.s1.snmp.cpu": "[[1, 100]]",
+            "base.dc2.s2.snmp.cpu": "[[3, 100]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-server-query", "base.*.*", "-server-full-path")
+
+    if len(out) != 2 {
+        t.Fatalf("got %d servers, want 2: %v", len(out), out)
+    }
+    for i, want := range []struct {
+        server  string
+        average float64
+    }{{"base.dc1.s1", 1}, {"base.dc2.s2", 3}} {
+        stats, ok := out[i][want.server]["cpu"]
+        if !ok || stats.Average != want.average {
+            t.Errorf("server %d = %v, want %s with cpu average %v", i, out[i], want.server, want.average)
+        }
+    }
+}
+
+func TestAggregateFlag(t *testing.T) {
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1", "base.s2"},
+            "base.s1.snmp.*": {"base.s1.snmp.cpu"},
+            "base.s2.snmp.*": {"base.s2.snmp.cpu"},
+        },
+        render: map[string]string{
+            "base.s1.snmp.cpu": "[[1, 100], [2, 200], [3, 300]]",
+            "base.s2.snmp.cpu": "[[10, 100], [20, 200]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-aggregate")
+
+    if len(out) != 3 {
+        t.Fatalf("got %d entries, want 2 servers and the aggregate", len(out))
+    }
+    aggregate, ok := out[2][aggregateKey]["cpu"]
+    if !ok {
+        t.Fatalf("last entry = %v, want %s", out[2], aggregateKey)
+    }
+    if aggregate.Count != 5 || aggregate.Average != 7.2 {
+        t.Errorf("aggregate count = %d, average = %v, want 5 and 7.2", aggregate.Count, aggregate.Average)
+    }
+}
+
+func TestPartialFailure(t *testing.T) {
+    tests := []struct {
+        name         string
+        args         []string
+        wantErr      bool
+        wantFailures int64
+        wantOutput   bool
+    }{
+        {"partial", nil, false, 1, true},
+        {"fail fast", []string{"-fail-fast"}, true, 1, false},
+        {"fail fast ndjson", []string{"-fail-fast", "-format", "ndjson"}, true, 1, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[1, 100]]"})
+            srv := httptest.NewServer(failing(f, "base.s1.snmp.mem"))
+            defer srv.Close()
+
+            data, failures, err := run(t, srv.URL, append([]string{"-base-dir", "base", "-retries", "0"}, tt.args...)...)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("run error = %v, want error %t", err, tt.wantErr)
+            }
+            if failures != tt.wantFailures {
+                t.Errorf("failures = %d, want %d", failures, tt.wantFailures)
+            }
+            if !tt.wantOutput {
+                if data != "" {
+                    t.Errorf("aborted run wrote %q, want nothing", data)
+                }
+                return
+            }
+
+            var out OutputFormat
+            if err := json.Unmarshal([]byte(data), &out); err != nil {
+                t.Fatalf("invalid JSON output: %v", err)
+            }
+            if _, ok := out[0]["s1"]["cpu"]; !ok || len(out[0]["s1"]) != 1 {
+                t.Errorf("output = %v, want only cpu", out)
+            }
+        })
+    }
+}
+
+func TestServersFile(t *testing.T) {
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]"})
+    srv := newFakeGraphite(t, f)
+    servers := writeFile(t, "servers", "# servers to collect\ns1\n\n")
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-servers-file", servers)
+
+    if _, ok := out[0]["s1"]["cpu"]; !ok {
+        t.Errorf("output = %v, want s1 cpu", out)
+    }
+    for _, r := range f.requested("/metrics/find") {
+        if strings.Contains(r, "query=base.*&") {
+            t.Errorf("servers were discovered with %s despite -servers-file", r)
+        }
+    }
+}
+
+func TestMultipleMetricsDirs(t *testing.T) {
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1"},
+            "base.s1.snmp.*": {"base.s1.snmp.if_in"},
+            "base.s1.cpu.*":  {"base.s1.cpu.load"},
+        },
+        render: map[string]string{
+            "base.s1.snmp.if_in": "[[1, 100]]",
+            "base.s1.cpu.load":   "[[2, 100]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-metrics-dir", "snmp, cpu")
+
+    // Keys are qualified with their directory so that they cannot collide.
+    s1 := out[0]["s1"]
+    if len(s1) != 2 || s1["snmp.if_in"].Average != 1 || s1["cpu.load"].Average != 2 {
+        t.Errorf("s1 = %v, want snmp.if_in and cpu.load", s1)
+    }
+}
+
+func TestServerWithoutMetrics(t *testing.T) {
+    tests := []struct {
+        name         string
+        args         []string
+        wantFailures int64
+        wantLog      string
+    }{
+        {"warns", nil, 0, "level=WARN msg=\"server has no metrics\" server=s1"},
+        {"require metrics", []string{"-require-metrics"}, 1, "level=ERROR msg=\"server has no metrics\" server=s1"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            logs := captureLogs(t)
+            srv := newFakeGraphite(t, &fakeGraphite{find: map[string][]string{"base.*": {"base.s1"}}})
+
+            _, failures, err := run(t, srv.URL, append([]string{"-base-dir", "base"}, tt.args...)...)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if failures != tt.wantFailures {
+                t.Errorf("failures = %d, want %d", failures, tt.wantFailures)
+            }
+            if !strings.Contains(logs.String(), tt.wantLog) {
+                t.Errorf("logs do not contain %q:\n%s", tt.wantLog, logs)
+            }
+        })
+    }
+}
+
+func TestDeterministicOutput(t *testing.T) {
+    f := &fakeGraphite{find: map[string][]string{}, render: map[string]string{}}
+    for s := 1; s <= 3; s++ {
+        server := fmt.Sprintf("base.s%d", s)
+        f.find["base.*"] = append(f.find["base.*"], server)
+        for m := 0; m < 10; m++ {
+            path := fmt.Sprintf("%s.snmp.m%d", server, m)
+            f.find[server+".snmp.*"] = append(f.find[server+".snmp.*"], path)
+            f.render[path] = fmt.Sprintf("[[%d, 100], [%d, 200]]", s*m, s+m)
+        }
+    }
+    srv := newFakeGraphite(t, f)
+
+    args := []string{"-base-dir", "base", "-concurrency", "8", "-server-concurrency", "3", "-aggregate"}
+    first, _, err := run(t, srv.URL, args...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 5; i++ {
+        again, _, err := run(t, srv.URL, args...)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if again != first {
+            t.Fatalf("run %d differs from the first:\n%s\nfirst:\n%s", i+2, again, first)
+        }
+    }
+}
+
+func TestMetricKeys(t *testing.T) {
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1"},
+            "base.s1.snmp.*": {"base.s1.snmp.load"},
+            "base.s1.cpu.*":  {"base.s1.cpu.load"},
+        },
+        render: map[string]string{
+            "base.s1.snmp.load": "[[1, 100]]",
+            "base.s1.cpu.load":  "[[2, 100]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    tests := []struct {
+        metricKey string
+        want      []string
+    }{
+        {"last", []string{"cpu.load", "snmp.load"}},
+        {"2", []string{"cpu.load", "snmp.load"}},
+        {"3", []string{"s1.cpu.load", "s1.snmp.load"}},
+        {"full", []string{"base.s1.cpu.load", "base.s1.snmp.load"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.metricKey, func(t *testing.T) {
+            out := runJSON(t, srv.URL, "-base-dir", "base", "-metrics-dir", "snmp,cpu", "-metric-key", tt.metricKey)
+
+            if got := sortedMetricNames(out[0]["s1"]); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("keys = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestMetricKey(t *testing.T) {
+    tests := []struct {
+        path     string
+        segments int
+        want     string
+    }{
+        {"base.s1.snmp.cpu", 1, "cpu"},
+        {"base.s1.snmp.cpu", 2, "snmp.cpu"},
+        {"base.s1.snmp.cpu", 0, "base.s1.snmp.cpu"},
+        {"cpu", 3, "cpu"},
+    }
+
+    for _, tt := range tests {
+        if got := metricKey(tt.path, tt.segments); got != tt.want {
+            t.Errorf("metricKey(%q, %d) = %q, want %q", tt.path, tt.segments, got, tt.want)
+        }
+    }
+}
+
+func TestMetricKeyCollision(t *testing.T) {
+    logs := captureLogs(t)
+    f := &fakeGraphite{
+        tagged: []string{"cpu;dc=a;host=s1", "cpu;dc=b;host=s1"},
+        render: map[string]string{
+            "cpu;dc=a;host=s1": "[[1, 100]]",
+            "cpu;dc=b;host=s1": "[[5, 100]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    data, failures, err := run(t, srv.URL, "-tag-query", "name=cpu")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if failures != 1 {
+        t.Errorf("failures = %d, want the collision counted", failures)
+    }
+    if want := `msg="metric key collision, earlier statistics overwritten" key=cpu metric="cpu;dc=b;host=s1" overwritten="cpu;dc=a;host=s1"`; !strings.Contains(logs.String(), want) {
+        t.Errorf("logs do not contain %q:\n%s", want, logs)
+    }
+
+    // The later metric in discovery order wins.
+    var out OutputFormat
+    if err := json.Unmarshal([]byte(data), &out); err != nil {
+        t.Fatal(err)
+    }
+    if got := out[0]["s1"]["cpu"].Average; got != 5 {
+        t.Errorf("cpu average = %v, want 5", got)
+    }
+}
+
+func TestTagQuery(t *testing.T) {
+    f := &fakeGraphite{
+        tagged: []string{"cpu;host=s1", "cpu;host=s2", "mem"},
+        render: map[string]string{
+            "cpu;host=s1": "[[1, 100]]",
+            "cpu;host=s2": "[[2, 100]]",
+            "mem":         "[[3, 100]]",
+        },
+    }
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-tag-query", "name=~.*")
+
+    want := []struct {
+        server  string
+        metric  string
+        average float64
+    }{{"s1", "cpu", 1}, {"s2", "cpu", 2}, {untaggedServer, "mem", 3}}
+    if len(out) != len(want) {
+        t.Fatalf("got %d servers, want %d: %v", len(out), len(want), out)
+    }
+    for i, w := range want {
+        if stats, ok := out[i][w.server][w.metric]; !ok || stats.Average != w.average {
+            t.Errorf("entry %d = %v, want %s %s with average %v", i, out[i], w.server, w.metric, w.average)
+        }
+    }
+}
+
+func TestDeadline(t *testing.T) {
+    logs := captureLogs(t)
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1", "base.s2"},
+            "base.s1.snmp.*": {"base.s1.snmp.cpu"},
+            "base.s2.snmp.*": {"base.s2.snmp.cpu"},
+        },
+        render: map[string]string{"base.s1.snmp.cpu": "[[1, 100]]", "base.s2.snmp.cpu": "[[2, 100]]"},
+    }
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("target") == "base.s2.snmp.cpu" {
+            select {
+            case <-r.Context().Done():
+            case <-time.After(5 * time.Second):
+            }
+            return
+        }
+        f.ServeHTTP(w, r)
+    }))
+    defer srv.Close()
+
+    start := time.Now()
+    data, _, err := run(t, srv.URL, "-base-dir", "base", "-deadline", "200ms", "-server-concurrency", "1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("run took %s, want it stopped by the 200ms deadline", elapsed)
+    }
+
+    var out OutputFormat
+    if err := json.Unmarshal([]byte(data), &out); err != nil {
+        t.Fatalf("partial output is not valid JSON: %v\n%s", err, data)
+    }
+    if got := out[0]["s1"]["cpu"].Average; got != 1 {
+        t.Errorf("s1 cpu average = %v, want 1 from before the deadline", got)
+    }
+    if !strings.Contains(logs.String(), "deadline exceeded, printing partial results") {
+        t.Errorf("no deadline warning in logs:\n%s", logs)
+    }
+}
+
+func TestQuietSummary(t *testing.T) {
+    logs := captureLogs(t)
+    f := singleServer(map[string]string{"cpu": "[[1, 100], [2, 200]]", "mem": "[[1, 100]]"})
+    srv := httptest.NewServer(failing(f, "base.s1.snmp.mem"))
+    defer srv.Close()
+
+    stderr := captureStderr(t)
+    _, failures, err := run(t, srv.URL, "-base-dir", "base", "-retries", "0", "-quiet", "-summary")
+    summary := stderr()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if failures != 1 {
+        t.Errorf("failures = %d, want 1", failures)
+    }
+    if strings.Contains(logs.String(), "level=ERROR") {
+        t.Errorf("-quiet still logged errors:\n%s", logs)
+    }
+    want := regexp.MustCompile(`^summary: 1 servers, 1 metrics, 2 datapoints, 1 errors, 0 retries in \S+\n$`)
+    if !want.MatchString(summary) {
+        t.Errorf("summary = %q, want it to match %s", summary, want)
+    }
+}
+
+func TestConcurrencyLimitAcrossServers(t *testing.T) {
+    f := &fakeGraphite{find: map[string][]string{}, render: map[string]string{}}
+    for s := 1; s <= 4; s++ {
+        server := fmt.Sprintf("base.s%d", s)
+        f.find["base.*"] = append(f.find["base.*"], server)
+        for m := 0; m < 5; m++ {
+            path := fmt.Sprintf("%s.snmp.m%d", server, m)
+            f.find[server+".snmp.*"] = append(f.find[server+".snmp.*"], path)
+            f.render[path] = "[[1, 100]]"
+        }
+    }
+    limiter := &inFlight{handler: f, delay: 20 * time.Millisecond}
+    srv := httptest.NewServer(limiter)
+    defer srv.Close()
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-concurrency", "3", "-server-concurrency", "4")
+
+    if len(out) != 4 {
+        t.Errorf("got %d servers, want 4", len(out))
+    }
+    if got := limiter.max.Load(); got > 3 {
+        t.Errorf("%d requests in flight across servers, want at most 3", got)
+    }
+}
+
+func TestFailFastCreatesNoOutput(t *testing.T) {
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[1, 100]]"})
+    srv := httptest.NewServer(failing(f, "base.s1.snmp.cpu"))
+    defer srv.Close()
+
+    output := filepath.Join(t.TempDir(), "out.json")
+    cfg, err := parseConfig([]string{"-graphite-url", srv.URL, "-base-dir", "base", "-progress=false", "-retries", "0", "-fail-fast", "-output", output})
+    if err != nil {
+        t.Fatal(err)
+    }
+    client, err := newGraphiteClient([]string{srv.URL}, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := runSnapshot(context.Background(), cfg, client); err == nil {
+        t.Fatal("runSnapshot succeeded despite -fail-fast and a failure")
+    }
+    if _, err := os.Stat(output); !os.IsNotExist(err) {
+        t.Errorf("-output exists after an aborted run (stat error %v)", err)
+    }
+}
+
+func TestOnlyServers(t *testing.T) {
+    logs := captureLogs(t)
+    f := &fakeGraphite{
+        find: map[string][]string{
+            "base.*":         {"base.s1", "base.s2", "base.s3"},
+            "base.s1.snmp.*": {"base.s1.snmp.cpu"},
+            "base.s3.snmp.*": {"base.s3.snmp.cpu"},
+        },
+        render: map[string]string{"base.s1.snmp.cpu": "[[1, 100]]", "base.s3.snmp.cpu": "[[3, 100]]"},
+    }
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-only-servers", "s3,s1,s9")
+
+    // Servers keep their discovery order, not the -only-servers order.
+    if len(out) != 2 || out[0]["s1"] == nil || out[1]["s3"] == nil {
+        t.Errorf("output = %v, want s1 then s3", out)
+    }
+    for _, r := range f.requested("/metrics/find") {
+        if strings.Contains(r, "base.s2.") {
+            t.Errorf("skipped server s2 was queried: %s", r)
+        }
+    }
+    if !strings.Contains(logs.String(), `msg="server from -only-servers was not discovered" server=s9`) {
+        t.Errorf("no warning about s9:\n%s", logs)
+    }
+}
+
+func TestMetricTimeout(t *testing.T) {
+    logs := captureLogs(t)
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]", "slow": "[[2, 100]]"})
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("target") == "base.s1.snmp.slow" {
+            select {
+            case <-r.Context().Done():
+            case <-time.After(5 * time.Second):
+            }
+            return
+        }
+        f.ServeHTTP(w, r)
+    }))
+    defer srv.Close()
+
+    start := time.Now()
+    data, failures, err := run(t, srv.URL, "-base-dir", "base", "-metric-timeout", "100ms")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("run took %s, want the slow metric dropped after 100ms", elapsed)
+    }
+    if failures != 1 {
+        t.Errorf("failures = %d, want 1", failures)
+    }
+
+    var out OutputFormat
+    if err := json.Unmarshal([]byte(data), &out); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := out[0]["s1"]["slow"]; ok || out[0]["s1"]["cpu"].Count != 1 {
+        t.Errorf("s1 = %v, want cpu without slow", out[0]["s1"])
+    }
+    if !strings.Contains(logs.String(), "metric=base.s1.snmp.slow") || !strings.Contains(logs.String(), "timed out after 100ms") {
+        t.Errorf("no timeout logged for the slow metric:\n%s", logs)
+    }
+}
+
+// memorySeries returns a series of values at timestamps 100, 200, ...
+func memorySeries(target string, values ...float64) []graphite.DataPoint {
+    dp := graphite.DataPoint{Target: target}
+    for i, v := range values {
+        v, ts := v, float64(100*(i+1))
+        dp.DataPoints = append(dp.DataPoints, []*float64{&v, &ts})
+    }
+
+    return []graphite.DataPoint{dp}
+}
+
+func TestSummaryCounts(t *testing.T) {
+    fetcher := &graphite.MemoryFetcher{
+        Servers: []string{"s1", "s2"},
+        Metrics: map[string][]string{
+            "s1": {"base.s1.snmp.cpu", "base.s1.snmp.mem"},
+            "s2": {"base.s2.snmp.cpu", "base.s2.snmp.gone"},
+        },
+        Series: map[string][]graphite.DataPoint{
+            "base.s1.snmp.cpu": memorySeries("base.s1.snmp.cpu", 1, 2),
+            "base.s1.snmp.mem": memorySeries("base.s1.snmp.mem", 3),
+            "base.s2.snmp.cpu": memorySeries("base.s2.snmp.cpu", 4, 5),
+        },
+    }
+    cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false", "-summary", "-no-data", "error", "-output", filepath.Join(t.TempDir(), "out")})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    stderr := captureStderr(t)
+    failures, err := runSnapshot(context.Background(), cfg, fetcher)
+    summary := stderr()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // base.s2.snmp.gone has no data, which -no-data=error counts as an error.
+    if failures != 1 {
+        t.Errorf("failures = %d, want 1", failures)
+    }
+    if want := "summary: 2 servers, 3 metrics, 5 datapoints, 1 errors, 0 retries in "; !strings.HasPrefix(summary, want) {
+        t.Errorf("summary = %q, want it to start with %q", summary, want)
+    }
+}
+
+func TestCompactOutput(t *testing.T) {
+    tests := []struct {
+        name      string
+        args      []string
+        wantLines int
+    }{
+        {"indented", nil, 0},
+        {"compact", []string{"-compact"}, 1},
+        {"compact beats indent", []string{"-indent", "\t", "-compact"}, 1},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := newFakeGraphite(t, singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[2, 100]]"}))
+
+            data, _, err := run(t, srv.URL, append([]string{"-base-dir", "base"}, tt.args...)...)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !json.Valid([]byte(data)) {
+                t.Fatalf("invalid JSON: %s", data)
+            }
+            lines := strings.Count(data, "\n")
+            if tt.wantLines > 0 && lines != tt.wantLines || tt.wantLines == 0 && lines < 10 {
+                t.Errorf("output has %d lines:\n%s", lines, data)
+            }
+        })
+    }
+}
+
+func TestIndentInvalid(t *testing.T) {
+    if _, err := parseConfig([]string{"-indent", "--"}); err == nil {
+        t.Error("parseConfig accepted a non-whitespace -indent")
+    }
+}
+
+func TestRequestHeaders(t *testing.T) {
+    var header http.Header
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        header = r.Header.Clone()
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    runJSON(t, srv.URL, "-header", "X-Team: network", "-header", "X-Team: oob", "-header", "X-Scope-OrgID:42")
+
+    if got := header.Get("User-Agent"); got != userAgent() {
+        t.Errorf("User-Agent = %q, want %q", got, userAgent())
+    }
+    if got := header.Values("X-Team"); len(got) != 2 || got[0] != "network" || got[1] != "oob" {
+        t.Errorf("X-Team = %q, want [network oob]", got)
+    }
+    if got := header.Get("X-Scope-OrgID"); got != "42" {
+        t.Errorf("X-Scope-OrgID = %q, want 42", got)
+    }
+}
+
+func TestHeaderFlagInvalid(t *testing.T) {
+    for _, header := range []string{"no colon", ": value", "Authorization: Bearer x", "accept-encoding: br"} {
+        if _, err := parseConfig([]string{"-header", header}); err == nil {
+            t.Errorf("parseConfig accepted -header %q", header)
+        }
+    }
+}
+
+func TestMaxMetricsPerServer(t *testing.T) {
+    logs := captureLogs(t)
+    f := singleServer(map[string]string{"a": "[[1, 100]]", "b": "[[2, 100]]", "c": "[[3, 100]]", "d": "[[4, 100]]"})
+    srv := newFakeGraphite(t, f)
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-max-metrics-per-server", "2")
+
+    // The first metrics in discovery order are kept.
+    if got := sortedMetricNames(out[0]["s1"]); !reflect.DeepEqual(got, []string{"a", "b"}) {
+        t.Errorf("metrics = %q, want [a b]", got)
+    }
+    if got := len(f.requested("/render")); got != 2 {
+        t.Errorf("%d render requests, want 2", got)
+    }
+    if !strings.Contains(logs.String(), "server exceeds -max-metrics-per-server, skipping the rest\" server=s1 limit=2 skipped=2") {
+        t.Errorf("no warning about the cap:\n%s", logs)
+    }
+}
+
+func TestBatchSize(t *testing.T) {
+    f := singleServer(map[string]string{
+        "a": "[[1, 100], [3, 200]]",
+        "b": "[[10, 100]]",
+        "c": "[[5, 100], [null, 200]]",
+        "d": "[[-2, 100], [2, 200]]",
+        "e": "[[7, 100]]",
+    })
+    var methods []string
+    var mu sync.Mutex
+    srv := newFakeGraphite(t, &fakeGraphite{})
+    srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/render" {
+            mu.Lock()
+            methods = append(methods, r.Method)
+            mu.Unlock()
+        }
+        f.ServeHTTP(w, r)
+    })
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-batch-size", "2")
+
+    if got := f.requested("/render"); len(got) != 3 {
+        t.Errorf("render requests = %q, want 3 for 5 metrics in batches of 2", got)
+    }
+    for _, method := range methods {
+        if method != http.MethodPost {
+            t.Errorf("render method = %s, want POST", method)
+        }
+    }
+
+    want := map[string]struct {
+        count   int
+        average float64
+    }{
+        "a": {2, 2},
+        "b": {1, 10},
+        "c": {1, 5},
+        "d": {2, 0},
+        "e": {1, 7},
+    }
+    stats := out[0]["s1"]
+    if len(stats) != len(want) {
+        t.Fatalf("got stats for %d metrics, want %d", len(stats), len(want))
+    }
+    for metric, w := range want {
+        if got := stats[metric]; got.Count != w.count || got.Average != w.average {
+            t.Errorf("%s: count %d, average %v, want %d, %v", metric, got.Count, got.Average, w.count, w.average)
+        }
+    }
+}
+
+func TestNoDataPolicy(t *testing.T) {
+    tests := []struct {
+        policy       string
+        wantFailures int64
+        wantEmpty    bool
+    }{
+        {"", 0, false},
+        {"skip", 0, false},
+        {"zero", 0, true},
+        {"error", 1, false},
+    }
+
+    for _, tt := range tests {
+        name := tt.policy
+        if name == "" {
+            name = "default"
+        }
+        t.Run(name, func(t *testing.T) {
+            srv := newFakeGraphite(t, singleServer(map[string]string{"cpu": "[[1, 100]]", "empty": "[]"}))
+
+            args := []string{"-base-dir", "base"}
+            if tt.policy != "" {
+                args = append(args, "-no-data", tt.policy)
+            }
+            data, failures, err := run(t, srv.URL, args...)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if failures != tt.wantFailures {
+                t.Errorf("failures = %d, want %d", failures, tt.wantFailures)
+            }
+            var out OutputFormat
+            if err := json.Unmarshal([]byte(data), &out); err != nil {
+                t.Fatalf("invalid JSON output %q: %v", data, err)
+            }
+            stats := out[0]["s1"]
+            if stats["cpu"].Count != 1 {
+                t.Errorf("cpu count = %d, want 1", stats["cpu"].Count)
+            }
+            empty, ok := stats["empty"]
+            if ok != tt.wantEmpty || ok && empty.Count != 0 {
+                t.Errorf("empty = %+v, %v, want present: %v with a zero count", empty, ok, tt.wantEmpty)
+            }
+        })
+    }
+}
+
+func TestRetriesInSummary(t *testing.T) {
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]", "mem": "[[2, 100]]"})
+    var mu sync.Mutex
+    failed := map[string]bool{}
+    srv := newFakeGraphite(t, &fakeGraphite{})
+    // Every target fails once with a 503 before succeeding.
+    srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/render" {
+            r.ParseForm()
+            mu.Lock()
+            first := !failed[r.Form.Get("target")]
+            failed[r.Form.Get("target")] = true
+            mu.Unlock()
+            if first {
+                w.WriteHeader(http.StatusServiceUnavailable)
+                return
+            }
+        }
+        f.ServeHTTP(w, r)
+    })
+
+    stderr := captureStderr(t)
+    data, failures, err := run(t, srv.URL, "-base-dir", "base", "-retries", "2", "-summary")
+    summary := stderr()
+    if err != nil || failures != 0 {
+        t.Fatalf("run: %d failures, error %v", failures, err)
+    }
+
+    if !strings.Contains(data, `"cpu"`) || !strings.Contains(data, `"mem"`) {
+        t.Errorf("output %s is missing a retried metric", data)
+    }
+    if want := ", 2 retries in "; !strings.Contains(summary, want) {
+        t.Errorf("summary = %q, want it to contain %q", summary, want)
+    }
+}
+
+func TestIncludeDataPoints(t *testing.T) {
+    tests := []struct {
+        name string
+        args []string
+        want [][2]float64
+    }{
+        {"off", nil, nil},
+        {"on", []string{"-include-datapoints"}, [][2]float64{{4, 100}, {2.5, 300}}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := newFakeGraphite(t, singleServer(map[string]string{"cpu": "[[4, 100], [null, 200], [2.5, 300]]"}))
+
+            out := runJSON(t, srv.URL, append([]string{"-base-dir", "base"}, tt.args...)...)
+
+            stats := out[0]["s1"]["cpu"]
+            if !reflect.DeepEqual(stats.DataPoints, tt.want) {
+                t.Errorf("datapoints = %v, want %v", stats.DataPoints, tt.want)
+            }
+            if tt.want != nil && len(stats.DataPoints) != stats.Count {
+                t.Errorf("got %d datapoints for a count of %d", len(stats.DataPoints), stats.Count)
+            }
+        })
+    }
+}
+
+func TestCompareWindows(t *testing.T) {
+    current := singleServer(map[string]string{
+        "cpu": "[[4, 1700000100], [8, 1700000200]]",
+        "mem": "[[1, 1700000100]]",
+        "old": "[]",
+    })
+    previous := singleServer(map[string]string{
+        "cpu": "[[1, 1699996500], [2, 1699996600], [3, 1699996700]]",
+        "mem": "[]",
+        "old": "[[5, 1699996500]]",
+    })
+    srv := newFakeGraphite(t, current)
+    srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        if r.URL.Path == "/render" && r.Form.Get("from") == "1699996400" {
+            previous.ServeHTTP(w, r)
+            return
+        }
+        current.ServeHTTP(w, r)
+    })
+
+    out := runJSON(t, srv.URL, "-base-dir", "base", "-no-data", "zero",
+        "-from", "1700000000", "-until", "1700003600",
+        "-compare-from", "1699996400", "-compare-until", "1700000000")
+
+    stats := out[0]["s1"]
+    tests := []struct {
+        metric string
+        want   *graphite.Delta
+    }{
+        {"cpu", &graphite.Delta{Count: -1, Average: 4, Sum: 6, Maximum: 5, Minimum: 3, StandardDeviation: 2 - math.Sqrt(2.0/3)}},
+        // No datapoints in the comparison window, so nothing to compare.
+        {"mem", nil},
+        // No datapoints in the current window: -no-data zero compares an
+        // empty window against the earlier one.
+        {"old", &graphite.Delta{Count: -1, Average: -5, Sum: -5, Maximum: -5, Minimum: -5}},
+    }
+    for _, tt := range tests {
+        got := stats[tt.metric].Delta
+        if (got == nil) != (tt.want == nil) {
+            t.Errorf("%s: delta = %+v, want %+v", tt.metric, got, tt.want)
+            continue
+        }
+        if got != nil && (got.Count != tt.want.Count || got.Average != tt.want.Average || got.Sum != tt.want.Sum ||
+            got.Maximum != tt.want.Maximum || got.Minimum != tt.want.Minimum || math.Abs(got.StandardDeviation-tt.want.StandardDeviation) > 1e-9) {
+            t.Errorf("%s: delta = %+v, want %+v", tt.metric, *got, *tt.want)
+        }
+    }
+}
+
+func TestMetricsAllowlist(t *testing.T) {
+    allowlist := writeFile(t, "allowlist", "# curated\nbase.s1.snmp.cpu\n\n  base.s1.snmp.if_in  \nbase.s1.snmp.undiscovered\n")
+
+    tests := []struct {
+        name string
+        args []string
+        want []string
+    }{
+        {"allowlist", []string{"-metrics-allowlist", allowlist}, []string{"cpu", "if_in"}},
+        {"with exclude", []string{"-metrics-allowlist", allowlist, "-exclude", "if_"}, []string{"cpu"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := singleServer(map[string]string{"cpu": "[[1, 100]]", "if_in": "[[2, 100]]", "if_out": "[[3, 100]]", "mem": "[[4, 100]]"})
+            srv := newFakeGraphite(t, f)
+
+            out := runJSON(t, srv.URL, append([]string{"-base-dir", "base"}, tt.args...)...)
+
+            if got := sortedMetricNames(out[0]["s1"]); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("metrics = %q, want %q", got, tt.want)
+            }
+            if got := f.requested("/render"); len(got) != len(tt.want) {
+                t.Errorf("render requests = %q, want one per allowed metric", got)
+            }
+        })
+    }
+}
+
+func TestSkipEmptyServers(t *testing.T) {
+    tests := []struct {
+        name        string
+        args        []string
+        wantServers []string
+    }{
+        {"kept", nil, []string{"s1", "s2", "s3"}},
+        {"skipped", []string{"-skip-empty-servers"}, []string{"s1"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            // s2 has only metrics without data and s3 no metrics at all.
+            srv := newFakeGraphite(t, &fakeGraphite{
+                find: map[string][]string{
+                    "base.*":         {"base.s1", "base.s2", "base.s3"},
+                    "base.s1.snmp.*": {"base.s1.snmp.cpu"},
+                    "base.s2.snmp.*": {"base.s2.snmp.cpu"},
+                },
+                render: map[string]string{"base.s1.snmp.cpu": "[[1, 100]]", "base.s2.snmp.cpu": "[]"},
+            })
+
+            out := runJSON(t, srv.URL, append([]string{"-base-dir", "base", "-no-data", "skip"}, tt.args...)...)
+
+            var servers []string
+            for _, entry := range out {
+                for server, stats := range entry {
+                    servers = append(servers, server)
+                    if server != "s1" && len(stats) != 0 {
+                        t.Errorf("%s has statistics %v, want none", server, stats)
+                    }
+                }
+            }
+            if !reflect.DeepEqual(servers, tt.wantServers) {
+                t.Errorf("servers = %q, want %q", servers, tt.wantServers)
+            }
+        })
+    }
+}
+
+func TestRunSnapshotWithMemoryFetcher(t *testing.T) {
+    fetcher := &graphite.MemoryFetcher{
+        Servers: []string{"s2", "s1"},
+        Metrics: map[string][]string{
+            "s1": {"base.s1.snmp.cpu", "base.s1.snmp.mem"},
+            "s2": {"base.s2.snmp.cpu"},
+        },
+        Series: map[string][]graphite.DataPoint{
+            "base.s1.snmp.cpu": memorySeries("base.s1.snmp.cpu", 1, 3),
+            "base.s1.snmp.mem": memorySeries("base.s1.snmp.mem", 0.5),
+            "base.s2.snmp.cpu": memorySeries("base.s2.snmp.cpu", 2, 4, 6),
+        },
+    }
+    output := filepath.Join(t.TempDir(), "out.csv")
+    cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false", "-sort", "name", "-aggregate", "-format", "csv", "-output", output})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    failures, err := runSnapshot(context.Background(), cfg, fetcher)
+    if err != nil || failures != 0 {
+        t.Fatalf("runSnapshot: %d failures, error %v", failures, err)
+    }
+
+    data, err := os.ReadFile(output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Servers come out sorted, with the aggregate over both last.
+    want := "server,metric,count,average,sum,maximum,minimum,standard_deviation\n" +
+        "s1,cpu,2,2,4,3,1,1\n" +
+        "s1,mem,1,0.5,0.5,0.5,0.5,0\n" +
+        "s2,cpu,3,4,12,6,2,1.632993161855452\n" +
+        "_aggregate,cpu,5,3.2,16,6,1,1.7204650534085253\n" +
+        "_aggregate,mem,1,0.5,0.5,0.5,0.5,0\n"
+    if string(data) != want {
+        t.Errorf("output:\n%s\nwant:\n%s", data, want)
+    }
+}
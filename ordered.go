@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+)
+
+// orderedResults forwards servers to a resultWriter in discovery order
+// while they complete in any order, holding back each server until every
+// server before it is done. The aggregate is built in the same order so
+// that it does not depend on scheduling either.
+type orderedResults struct {
+    results resultWriter
+    servers []string
+
+    mu        sync.Mutex
+    done      []bool
+    stats     []ServerStatistics
+    next      int
+    aggregate ServerStatistics
+    err       error
+}
+
+func newOrderedResults(results resultWriter, servers []string, aggregate bool) *orderedResults {
+    o := &orderedResults{
+        results: results,
+        servers: servers,
+        done:    make([]bool, len(servers)),
+        stats:   make([]ServerStatistics, len(servers)),
+    }
+    if aggregate {
+        o.aggregate = ServerStatistics{}
+    }
+
+    return o
+}
+
+// complete records the statistics of servers[i] and writes every server
+// that is now ready. It returns the first write error, after which
+// nothing more is written.
+func (o *orderedResults) complete(i int, serverStats ServerStatistics) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    o.done[i] = true
+    o.stats[i] = serverStats
+    o.flush()
+
+    return o.err
+}
+
+// skip marks servers[i] as done without writing it.
+func (o *orderedResults) skip(i int) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    o.done[i] = true
+    o.flush()
+}
+
+func (o *orderedResults) flush() {
+    for ; o.next < len(o.servers) && o.done[o.next]; o.next++ {
+        serverStats := o.stats[o.next]
+        o.stats[o.next] = nil
+        if serverStats == nil || o.err != nil {
+            continue
+        }
+
+        if o.aggregate != nil {
+            aggregateServer(o.aggregate, serverStats)
+        }
+        if err := o.results.WriteServer(o.servers[o.next], serverStats); err != nil {
+            o.err = fmt.Errorf("failed to write output: %w", err)
+        }
+    }
+}
+
+// finish writes the aggregate, if any, once every worker has returned.
+// Servers never reached because the run was cancelled are left out.
+func (o *orderedResults) finish() error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if o.err != nil {
+        return o.err
+    }
+    if o.aggregate != nil {
+        if err := o.results.WriteServer(aggregateKey, o.aggregate); err != nil {
+            return fmt.Errorf("failed to write output: %w", err)
+        }
+    }
+
+    return nil
+}
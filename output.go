@@ -0,0 +1,533 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "graphite/graphite"
+)
+
+const (
+    sortName    = "name"
+    sortAverage = "average"
+    sortMax     = "max"
+    sortCount   = "count"
+)
+
+const (
+    formatJSON       = "json"
+    formatCSV        = "csv"
+    formatNDJSON     = "ndjson"
+    formatPrometheus = "prometheus"
+    formatTable      = "table"
+)
+
+// tableMetricWidth is the longest metric name printed by -format table;
+// longer names keep their end, which is the part that tells them apart.
+const tableMetricWidth = 48
+
+// schemaVersion identifies the layout of the -wrap envelope. Bump it on
+// incompatible changes; new fields alone do not require a bump.
+const schemaVersion = 1
+
+var csvHeader = []string{"server", "metric", "count", "average", "sum", "maximum", "minimum", "standard_deviation"}
+
+type nopWriteCloser struct {
+    io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func openOutput(cfg Config) (io.WriteCloser, error) {
+    if cfg.Output == "" {
+        return nopWriteCloser{os.Stdout}, nil
+    }
+
+    path := cfg.Output
+    if cfg.GzipOutput && !strings.HasSuffix(path, ".gz") {
+        path += ".gz"
+    }
+
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create output file: %v", err)
+    }
+    if cfg.GzipOutput {
+        return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+    }
+
+    return f, nil
+}
+
+// writePending writes data, produced in full beforehand, to the configured
+// output.
+func writePending(cfg Config, data []byte) error {
+    out, err := openOutput(cfg)
+    if err != nil {
+        return err
+    }
+    if _, err := out.Write(data); err != nil {
+        out.Close()
+        return fmt.Errorf("failed to write output: %w", err)
+    }
+    if err := out.Close(); err != nil {
+        return fmt.Errorf("failed to write output: %w", err)
+    }
+
+    return nil
+}
+
+// gzipFile compresses everything written to it into f. Close writes the
+// gzip footer before closing f; without it the file is truncated.
+type gzipFile struct {
+    *gzip.Writer
+    f *os.File
+}
+
+func (g *gzipFile) Close() error {
+    err := g.Writer.Close()
+    if closeErr := g.f.Close(); err == nil {
+        err = closeErr
+    }
+
+    return err
+}
+
+// resultWriter receives each server's statistics as soon as they are
+// computed. Close flushes anything buffered; it does not close the
+// underlying output.
+type resultWriter interface {
+    WriteServer(server string, serverStats ServerStatistics) error
+    Close() error
+}
+
+func newResultWriter(w io.Writer, cfg Config) resultWriter {
+    var results resultWriter
+    switch {
+    case cfg.Format == formatNDJSON:
+        results = &ndjsonWriter{enc: json.NewEncoder(w)}
+    case cfg.Format == formatJSON && !cfg.Wrap:
+        results = &jsonStreamWriter{w: w, indent: cfg.Indent}
+    default:
+        results = &bufferedWriter{w: w, format: cfg.Format, indent: cfg.Indent, wrap: cfg.Wrap, baseDir: cfg.BaseDir}
+    }
+
+    if cfg.Sort != "" {
+        results = &sortingWriter{results: results, key: cfg.Sort, desc: cfg.SortDesc}
+    }
+
+    return results
+}
+
+// sortingWriter holds every server back until Close and then forwards
+// them to results ordered by key. Servers are ranked by a statistic of the
+// graphite.Aggregate of all their metrics: the count-weighted average, the
+// largest maximum or the total count. Ties, and -sort=name, fall back to
+// the server name. The aggregate entry is always written last.
+type sortingWriter struct {
+    results resultWriter
+    key     string
+    desc    bool
+
+    servers   []sortedServer
+    aggregate ServerStatistics
+}
+
+type sortedServer struct {
+    name  string
+    stats ServerStatistics
+    rank  float64
+}
+
+func (s *sortingWriter) WriteServer(server string, serverStats ServerStatistics) error {
+    if server == aggregateKey {
+        s.aggregate = serverStats
+        return nil
+    }
+
+    s.servers = append(s.servers, sortedServer{name: server, stats: serverStats, rank: serverRank(serverStats, s.key)})
+    return nil
+}
+
+func (s *sortingWriter) Close() error {
+    sort.SliceStable(s.servers, func(i, j int) bool {
+        a, b := s.servers[i], s.servers[j]
+        if s.desc {
+            a, b = b, a
+        }
+        if a.rank != b.rank {
+            return a.rank < b.rank
+        }
+        return a.name < b.name
+    })
+
+    for _, server := range s.servers {
+        if err := s.results.WriteServer(server.name, server.stats); err != nil {
+            return err
+        }
+    }
+    if s.aggregate != nil {
+        if err := s.results.WriteServer(aggregateKey, s.aggregate); err != nil {
+            return err
+        }
+    }
+
+    return s.results.Close()
+}
+
+// serverRank is the value a server is sorted by for key; it is 0 for
+// -sort=name so that only names are compared.
+func serverRank(serverStats ServerStatistics, key string) float64 {
+    stats := make([]graphite.MetricStatistics, 0, len(serverStats))
+    for _, metric := range sortedMetricNames(serverStats) {
+        stats = append(stats, serverStats[metric])
+    }
+    total := graphite.Aggregate(stats...)
+
+    switch key {
+    case sortAverage:
+        return total.Average
+    case sortMax:
+        return total.Maximum
+    case sortCount:
+        return float64(total.Count)
+    default:
+        return 0
+    }
+}
+
+// bufferedWriter collects the whole OutputFormat for formats that cannot
+// be written incrementally.
+type bufferedWriter struct {
+    w       io.Writer
+    format  string
+    indent  string
+    wrap    bool
+    baseDir string
+    output  OutputFormat
+}
+
+func (b *bufferedWriter) WriteServer(server string, serverStats ServerStatistics) error {
+    b.output = append(b.output, map[string]ServerStatistics{server: serverStats})
+    return nil
+}
+
+func (b *bufferedWriter) Close() error {
+    if b.wrap {
+        return writeJSON(b.w, wrappedOutput{
+            SchemaVersion: schemaVersion,
+            GeneratedAt:   time.Now().UTC(),
+            BaseDir:       b.baseDir,
+            Servers:       b.output,
+        }, b.indent)
+    }
+
+    return writeOutput(b.w, b.format, b.output, b.indent)
+}
+
+// wrappedOutput is the -wrap envelope. Servers holds exactly what the
+// unwrapped JSON output would contain.
+type wrappedOutput struct {
+    SchemaVersion int          `json:"schema_version"`
+    GeneratedAt   time.Time    `json:"generated_at"`
+    BaseDir       string       `json:"base_dir"`
+    Servers       OutputFormat `json:"servers"`
+}
+
+// jsonStreamWriter writes the JSON array one server at a time, producing
+// the same bytes as writeJSON does for the whole OutputFormat.
+type jsonStreamWriter struct {
+    w       io.Writer
+    indent  string
+    written bool
+}
+
+func (j *jsonStreamWriter) WriteServer(server string, serverStats ServerStatistics) error {
+    entry, err := marshalJSON(map[string]ServerStatistics{server: serverStats}, j.indent, j.indent)
+    if err != nil {
+        return err
+    }
+
+    sep := "," + j.newline() + j.indent
+    if !j.written {
+        sep = "[" + j.newline() + j.indent
+        j.written = true
+    }
+    if _, err := io.WriteString(j.w, sep); err != nil {
+        return err
+    }
+    _, err = j.w.Write(entry)
+    return err
+}
+
+func (j *jsonStreamWriter) Close() error {
+    if !j.written {
+        // writeJSON marshals an empty OutputFormat as null.
+        _, err := io.WriteString(j.w, "null\n")
+        return err
+    }
+
+    _, err := io.WriteString(j.w, j.newline()+"]\n")
+    return err
+}
+
+func (j *jsonStreamWriter) newline() string {
+    if j.indent == "" {
+        return ""
+    }
+
+    return "\n"
+}
+
+type metricRecord struct {
+    Server string `json:"server"`
+    Metric string `json:"metric"`
+    graphite.MetricStatistics
+}
+
+type ndjsonWriter struct {
+    enc *json.Encoder
+}
+
+func (n *ndjsonWriter) WriteServer(server string, serverStats ServerStatistics) error {
+    for _, metric := range sortedMetricNames(serverStats) {
+        record := metricRecord{Server: server, Metric: metric, MetricStatistics: serverStats[metric]}
+        if err := n.enc.Encode(record); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (n *ndjsonWriter) Close() error {
+    return nil
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteServer(string, ServerStatistics) error { return nil }
+
+func (discardWriter) Close() error { return nil }
+
+func writeOutput(w io.Writer, format string, output OutputFormat, indent string) error {
+    switch format {
+    case formatJSON:
+        return writeJSON(w, output, indent)
+    case formatCSV:
+        return writeCSV(w, output)
+    case formatPrometheus:
+        return writePrometheus(w, output)
+    case formatTable:
+        return writeTable(w, output)
+    default:
+        return fmt.Errorf("unsupported output format %q", format)
+    }
+}
+
+// writeJSON writes output indented by indent, or compact when indent is
+// empty.
+func writeJSON(w io.Writer, output any, indent string) error {
+    jsonOutput, err := marshalJSON(output, "", indent)
+    if err != nil {
+        return err
+    }
+
+    _, err = fmt.Fprintln(w, string(jsonOutput))
+    return err
+}
+
+func marshalJSON(v any, prefix, indent string) ([]byte, error) {
+    if indent == "" {
+        return json.Marshal(v)
+    }
+
+    return json.MarshalIndent(v, prefix, indent)
+}
+
+func writeCSV(w io.Writer, output OutputFormat) error {
+    cw := csv.NewWriter(w)
+
+    labels := labelNames(output)
+    header := append([]string{}, csvHeader...)
+    for _, name := range labels {
+        header = append(header, "label_"+name)
+    }
+    if err := cw.Write(header); err != nil {
+        return err
+    }
+
+    for _, entry := range output {
+        for server, serverStats := range entry {
+            for _, metric := range sortedMetricNames(serverStats) {
+                stats := serverStats[metric]
+                record := []string{
+                    server,
+                    metric,
+                    strconv.Itoa(stats.Count),
+                    formatFloat(stats.Average),
+                    formatFloat(stats.Sum),
+                    formatFloat(stats.Maximum),
+                    formatFloat(stats.Minimum),
+                    formatFloat(stats.StandardDeviation),
+                }
+                for _, name := range labels {
+                    record = append(record, stats.Labels[name])
+                }
+                if err := cw.Write(record); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    cw.Flush()
+    return cw.Error()
+}
+
+func writeTable(w io.Writer, output OutputFormat) error {
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+    labels := labelNames(output)
+    fmt.Fprint(tw, "SERVER\tMETRIC\tAVG\tMAX\tMIN\tCOUNT")
+    for _, name := range labels {
+        fmt.Fprint(tw, "\t"+strings.ToUpper(name))
+    }
+    fmt.Fprintln(tw)
+    for _, entry := range output {
+        for server, serverStats := range entry {
+            for _, metric := range sortedMetricNames(serverStats) {
+                stats := serverStats[metric]
+                fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d",
+                    server,
+                    truncateLeft(metric, tableMetricWidth),
+                    formatTableFloat(stats.Average),
+                    formatTableFloat(stats.Maximum),
+                    formatTableFloat(stats.Minimum),
+                    stats.Count)
+                for _, name := range labels {
+                    fmt.Fprint(tw, "\t"+stats.Labels[name])
+                }
+                fmt.Fprintln(tw)
+            }
+        }
+    }
+
+    return tw.Flush()
+}
+
+// truncateLeft shortens s to width runes by replacing its start with "...".
+func truncateLeft(s string, width int) string {
+    runes := []rune(s)
+    if len(runes) <= width {
+        return s
+    }
+
+    return "..." + string(runes[len(runes)-width+3:])
+}
+
+func formatTableFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+var prometheusFamilies = []struct {
+    name  string
+    help  string
+    value func(graphite.MetricStatistics) float64
+}{
+    {"graphite_metric_average", "Average of the Graphite datapoints.", func(s graphite.MetricStatistics) float64 { return s.Average }},
+    {"graphite_metric_maximum", "Maximum of the Graphite datapoints.", func(s graphite.MetricStatistics) float64 { return s.Maximum }},
+    {"graphite_metric_minimum", "Minimum of the Graphite datapoints.", func(s graphite.MetricStatistics) float64 { return s.Minimum }},
+    {"graphite_metric_standard_deviation", "Standard deviation of the Graphite datapoints.", func(s graphite.MetricStatistics) float64 { return s.StandardDeviation }},
+    {"graphite_metric_count", "Number of non-null Graphite datapoints.", func(s graphite.MetricStatistics) float64 { return float64(s.Count) }},
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writePrometheus(w io.Writer, output OutputFormat) error {
+    bw := bufio.NewWriter(w)
+
+    for _, family := range prometheusFamilies {
+        fmt.Fprintf(bw, "# HELP %s %s\n", family.name, family.help)
+        fmt.Fprintf(bw, "# TYPE %s gauge\n", family.name)
+
+        for _, entry := range output {
+            for server, serverStats := range entry {
+                for _, metric := range sortedMetricNames(serverStats) {
+                    stats := serverStats[metric]
+                    fmt.Fprintf(bw, "%s{server=\"%s\",metric=\"%s\"%s} %s\n",
+                        family.name,
+                        prometheusLabelEscaper.Replace(server),
+                        prometheusLabelEscaper.Replace(metric),
+                        prometheusLabels(stats.Labels),
+                        formatFloat(family.value(stats)))
+                }
+            }
+        }
+    }
+
+    return bw.Flush()
+}
+
+// prometheusLabels formats labels, sorted by name, for appending to the
+// server and metric labels.
+func prometheusLabels(labels map[string]string) string {
+    names := make([]string, 0, len(labels))
+    for name := range labels {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var b strings.Builder
+    for _, name := range names {
+        fmt.Fprintf(&b, ",%s=\"%s\"", name, prometheusLabelEscaper.Replace(labels[name]))
+    }
+
+    return b.String()
+}
+
+// labelNames returns the names of every label in output, sorted, for the
+// csv and table formats to give each its own column.
+func labelNames(output OutputFormat) []string {
+    seen := map[string]bool{}
+    var names []string
+    for _, entry := range output {
+        for _, serverStats := range entry {
+            for _, stats := range serverStats {
+                for name := range stats.Labels {
+                    if !seen[name] {
+                        seen[name] = true
+                        names = append(names, name)
+                    }
+                }
+            }
+        }
+    }
+    sort.Strings(names)
+
+    return names
+}
+
+func sortedMetricNames(serverStats ServerStatistics) []string {
+    names := make([]string, 0, len(serverStats))
+    for name := range serverStats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    return names
+}
+
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'f', -1, 64)
+}
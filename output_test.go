@@ -0,0 +1,304 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testOutput is a single server with two metrics.
+var testOutput = OutputFormat{{"s1": ServerStatistics{
+    "cpu": {Count: 2, Average: 1.5, Sum: 3, Maximum: 2, Minimum: 1, StandardDeviation: 0.5},
+    "mem": {Count: 1, Average: 0.25, Sum: 0.25, Maximum: 0.25, Minimum: 0.25},
+}}}
+
+func TestWriteCSV(t *testing.T) {
+    var buf bytes.Buffer
+    if err := writeOutput(&buf, formatCSV, testOutput, ""); err != nil {
+        t.Fatal(err)
+    }
+
+    want := "server,metric,count,average,sum,maximum,minimum,standard_deviation\n" +
+        "s1,cpu,2,1.5,3,2,1,0.5\n" +
+        "s1,mem,1,0.25,0.25,0.25,0.25,0\n"
+    if got := buf.String(); got != want {
+        t.Errorf("CSV output:\n%s\nwant:\n%s", got, want)
+    }
+}
+
+func TestNDJSONWriter(t *testing.T) {
+    var buf bytes.Buffer
+    results := newResultWriter(&buf, Config{Format: formatNDJSON})
+    for server, serverStats := range testOutput[0] {
+        if err := results.WriteServer(server, serverStats); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := results.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("got %d lines, want one per metric:\n%s", len(lines), buf.String())
+    }
+    for i, want := range []struct {
+        metric string
+        count  int
+    }{{"cpu", 2}, {"mem", 1}} {
+        var record struct {
+            Server string `json:"server"`
+            Metric string `json:"metric"`
+            Count  int    `json:"count"`
+        }
+        if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+            t.Fatalf("line %d is not JSON: %v", i+1, err)
+        }
+        if record.Server != "s1" || record.Metric != want.metric || record.Count != want.count {
+            t.Errorf("line %d = %+v, want s1 %s with count %d", i+1, record, want.metric, want.count)
+        }
+    }
+}
+
+func TestWritePrometheus(t *testing.T) {
+    var buf bytes.Buffer
+    if err := writeOutput(&buf, formatPrometheus, testOutput, ""); err != nil {
+        t.Fatal(err)
+    }
+    got := buf.String()
+
+    for _, want := range []string{
+        "# HELP graphite_metric_average Average of the Graphite datapoints.\n# TYPE graphite_metric_average gauge\n",
+        `graphite_metric_average{server="s1",metric="cpu"} 1.5` + "\n",
+        `graphite_metric_average{server="s1",metric="mem"} 0.25` + "\n",
+        `graphite_metric_maximum{server="s1",metric="cpu"} 2` + "\n",
+        `graphite_metric_standard_deviation{server="s1",metric="cpu"} 0.5` + "\n",
+        `graphite_metric_count{server="s1",metric="mem"} 1` + "\n",
+    } {
+        if !strings.Contains(got, want) {
+            t.Errorf("exposition does not contain %q:\n%s", want, got)
+        }
+    }
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+    output := OutputFormat{{`s"1`: ServerStatistics{`a\b`: {Count: 1}}}}
+
+    var buf bytes.Buffer
+    if err := writeOutput(&buf, formatPrometheus, output, ""); err != nil {
+        t.Fatal(err)
+    }
+    if want := `graphite_metric_count{server="s\"1",metric="a\\b"} 1`; !strings.Contains(buf.String(), want) {
+        t.Errorf("exposition does not contain %q:\n%s", want, buf.String())
+    }
+}
+
+// writeResults writes output through the resultWriter cfg selects.
+func writeResults(t *testing.T, cfg Config, output OutputFormat) string {
+    t.Helper()
+
+    var buf bytes.Buffer
+    results := newResultWriter(&buf, cfg)
+    for _, entry := range output {
+        for server, serverStats := range entry {
+            if err := results.WriteServer(server, serverStats); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := results.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    return buf.String()
+}
+
+func TestWrapOutput(t *testing.T) {
+    cfg := Config{Format: formatJSON, Indent: "  ", BaseDir: "base"}
+    plain := writeResults(t, cfg, testOutput)
+    cfg.Wrap = true
+    wrapped := writeResults(t, cfg, testOutput)
+
+    var envelope struct {
+        SchemaVersion int             `json:"schema_version"`
+        GeneratedAt   time.Time       `json:"generated_at"`
+        BaseDir       string          `json:"base_dir"`
+        Servers       json.RawMessage `json:"servers"`
+    }
+    if err := json.Unmarshal([]byte(wrapped), &envelope); err != nil {
+        t.Fatalf("invalid wrapped JSON: %v", err)
+    }
+    if envelope.SchemaVersion != schemaVersion || envelope.BaseDir != "base" || time.Since(envelope.GeneratedAt) > time.Minute {
+        t.Errorf("envelope = %d, %q, %s, want schema %d, base, now", envelope.SchemaVersion, envelope.BaseDir, envelope.GeneratedAt, schemaVersion)
+    }
+
+    var servers, unwrapped OutputFormat
+    if err := json.Unmarshal(envelope.Servers, &servers); err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal([]byte(plain), &unwrapped); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(servers, unwrapped) {
+        t.Errorf("wrapped servers = %v, want the unwrapped output %v", servers, unwrapped)
+    }
+}
+
+func TestSortServers(t *testing.T) {
+    output := OutputFormat{
+        {"b": ServerStatistics{"cpu": {Count: 1, Average: 5, Maximum: 5}}},
+        {"c": ServerStatistics{"cpu": {Count: 10, Average: 1, Maximum: 9}}},
+        {"a": ServerStatistics{"cpu": {Count: 3, Average: 3, Maximum: 4}}},
+    }
+
+    tests := []struct {
+        key  string
+        desc bool
+        want []string
+    }{
+        {"name", false, []string{"a", "b", "c"}},
+        {"name", true, []string{"c", "b", "a"}},
+        {"average", false, []string{"c", "a", "b"}},
+        {"max", true, []string{"c", "b", "a"}},
+        {"count", false, []string{"b", "a", "c"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(fmt.Sprintf("%s desc=%t", tt.key, tt.desc), func(t *testing.T) {
+            data := writeResults(t, Config{Format: formatJSON, Sort: tt.key, SortDesc: tt.desc}, output)
+
+            var sorted OutputFormat
+            if err := json.Unmarshal([]byte(data), &sorted); err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            for _, entry := range sorted {
+                for server := range entry {
+                    got = append(got, server)
+                }
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("order = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestStreamingMatchesBuffered(t *testing.T) {
+    output := OutputFormat{
+        {"s1": testOutput[0]["s1"]},
+        {"s2": ServerStatistics{}},
+        {"s3": ServerStatistics{"load": {Count: 4, Average: 0.5, Percentiles: map[string]float64{"p50": 0.5}}}},
+    }
+
+    for _, indent := range []string{"  ", "\t", ""} {
+        t.Run(fmt.Sprintf("indent %q", indent), func(t *testing.T) {
+            streamed := writeResults(t, Config{Format: formatJSON, Indent: indent}, output)
+
+            var buffered bytes.Buffer
+            if err := writeOutput(&buffered, formatJSON, output, indent); err != nil {
+                t.Fatal(err)
+            }
+            if streamed != buffered.String() {
+                t.Errorf("streamed:\n%s\nbuffered:\n%s", streamed, buffered.String())
+            }
+        })
+    }
+}
+
+func TestWriteTable(t *testing.T) {
+    long := "collectd." + strings.Repeat("x", 50) + ".if_octets"
+    output := OutputFormat{{"s1": ServerStatistics{
+        "cpu": {Count: 2, Average: 1.5, Maximum: 2, Minimum: 1},
+        long:  {Count: 12, Average: 1234567.891, Maximum: -0.5, Minimum: -3},
+    }}}
+
+    var buf bytes.Buffer
+    if err := writeOutput(&buf, formatTable, output, ""); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    if len(lines) != 3 {
+        t.Fatalf("got %d lines, want a header and one per metric:\n%s", len(lines), buf.String())
+    }
+
+    header := lines[0]
+    if fields := strings.Fields(header); !reflect.DeepEqual(fields, []string{"SERVER", "METRIC", "AVG", "MAX", "MIN", "COUNT"}) {
+        t.Errorf("header = %q", header)
+    }
+    truncated := "..." + long[len(long)-tableMetricWidth+3:]
+    for i, want := range [][]string{
+        {"s1", truncated, "1.23457e+06", "-0.5", "-3", "12"},
+        {"s1", "cpu", "1.5", "2", "1", "2"},
+    } {
+        line := lines[i+1]
+        if fields := strings.Fields(line); !reflect.DeepEqual(fields, want) {
+            t.Errorf("line %d = %q, want fields %q", i+2, fields, want)
+        }
+        // Every column starts where its header does.
+        for _, column := range []string{"METRIC", "AVG", "MAX", "MIN", "COUNT"} {
+            at := strings.Index(header, column)
+            if at >= len(line) || line[at] == ' ' || line[at-1] != ' ' {
+                t.Errorf("line %d: column %s does not start at %d:\n%s\n%s", i+2, column, at, header, line)
+            }
+        }
+    }
+}
+
+func TestGzipOutput(t *testing.T) {
+    tests := []struct {
+        output string
+        want   string
+    }{
+        {"stats.json", "stats.json.gz"},
+        {"stats.json.gz", "stats.json.gz"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.output, func(t *testing.T) {
+            dir := t.TempDir()
+            cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false", "-gzip-output", "-output", filepath.Join(dir, tt.output)})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if _, err := runSnapshot(context.Background(), cfg, memoryGraphite()); err != nil {
+                t.Fatal(err)
+            }
+
+            entries, err := os.ReadDir(dir)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(entries) != 1 || entries[0].Name() != tt.want {
+                t.Fatalf("output directory holds %v, want only %s", entries, tt.want)
+            }
+            f, err := os.Open(filepath.Join(dir, tt.want))
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer f.Close()
+            zr, err := gzip.NewReader(f)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // ReadAll checks the gzip footer, which only Close writes.
+            data, err := io.ReadAll(zr)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var out OutputFormat
+            if err := json.Unmarshal(data, &out); err != nil || out[0]["s1"]["cpu"].Count != 2 {
+                t.Errorf("decompressed output = %s, %v, want the s1 statistics", data, err)
+            }
+        })
+    }
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "sync"
+    "time"
+)
+
+const progressInterval = time.Second
+
+// progressReporter writes "processed N/M servers" lines at most once per
+// interval, always reporting the final count.
+type progressReporter struct {
+    w        io.Writer
+    total    int
+    interval time.Duration
+
+    mu   sync.Mutex
+    done int
+    last time.Time
+}
+
+func newProgressReporter(w io.Writer, total int) *progressReporter {
+    return &progressReporter{w: w, total: total, interval: progressInterval}
+}
+
+func (r *progressReporter) serverDone() {
+    if r == nil {
+        return
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    r.done++
+    now := time.Now()
+    if r.done < r.total && now.Sub(r.last) < r.interval {
+        return
+    }
+    r.last = now
+
+    fmt.Fprintf(r.w, "processed %d/%d servers\n", r.done, r.total)
+}
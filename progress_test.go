@@ -0,0 +1,38 @@
+package main
+
+import (
+    "bytes"
+    "testing"
+    "time"
+)
+
+func TestProgressReporter(t *testing.T) {
+    tests := []struct {
+        name     string
+        interval time.Duration
+        want     string
+    }{
+        {"every server", 0, "processed 1/3 servers\nprocessed 2/3 servers\nprocessed 3/3 servers\n"},
+        {"throttled", time.Hour, "processed 1/3 servers\nprocessed 3/3 servers\n"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var buf bytes.Buffer
+            r := newProgressReporter(&buf, 3)
+            r.interval = tt.interval
+            for i := 0; i < 3; i++ {
+                r.serverDone()
+            }
+
+            if got := buf.String(); got != tt.want {
+                t.Errorf("progress = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestProgressReporterDisabled(t *testing.T) {
+    var r *progressReporter
+    r.serverDone()
+}
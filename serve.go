@@ -0,0 +1,93 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "graphite/graphite"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// serve exposes the pipeline over HTTP on cfg.Serve until ctx is done.
+func serve(ctx context.Context, cfg Config, client graphite.Fetcher) error {
+    cfg.Progress = false
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok\n"))
+    })
+    mux.Handle("/statistics", statisticsHandler(cfg, client))
+
+    srv := &http.Server{Addr: cfg.Serve, Handler: mux}
+
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+        defer cancel()
+        srv.Shutdown(shutdownCtx)
+    }()
+
+    slog.Info("serving statistics", "addr", cfg.Serve)
+    if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+
+    return nil
+}
+
+// statisticsHandler runs the full pipeline for every request. The request
+// context cancels the run when the client disconnects.
+func statisticsHandler(cfg Config, client graphite.Fetcher) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx, cancel := context.WithCancel(r.Context())
+        defer cancel()
+
+        var buf bytes.Buffer
+        results := newResultWriter(&buf, cfg)
+
+        p := &pipeline{cfg: cfg, client: client, cancel: cancel}
+        err := p.collect(ctx, results)
+        p.reportFailures()
+        if err != nil {
+            slog.Error("run failed", "error", err)
+            http.Error(w, err.Error(), http.StatusBadGateway)
+            return
+        }
+        if err := results.Close(); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if r.Context().Err() != nil {
+            return
+        }
+        if cfg.FailFast && p.failures.Load() > 0 {
+            http.Error(w, "aborting after first failure", http.StatusBadGateway)
+            return
+        }
+
+        w.Header().Set("Content-Type", contentType(cfg.Format))
+        w.Header().Set("X-Failures", strconv.FormatInt(p.failures.Load(), 10))
+        w.Write(buf.Bytes())
+    })
+}
+
+func contentType(format string) string {
+    switch format {
+    case formatCSV:
+        return "text/csv"
+    case formatTable:
+        return "text/plain; charset=utf-8"
+    case formatNDJSON:
+        return "application/x-ndjson"
+    case formatPrometheus:
+        return "text/plain; version=0.0.4"
+    default:
+        return "application/json"
+    }
+}
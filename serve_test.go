@@ -0,0 +1,51 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "graphite/graphite"
+)
+
+// memoryGraphite is one server, s1, with a cpu metric of two datapoints.
+func memoryGraphite() *graphite.MemoryFetcher {
+    one, three, t1, t2 := 1.0, 3.0, 100.0, 200.0
+
+    return &graphite.MemoryFetcher{
+        Servers: []string{"s1"},
+        Metrics: map[string][]string{"s1": {"base.s1.snmp.cpu"}},
+        Series: map[string][]graphite.DataPoint{
+            "base.s1.snmp.cpu": {{Target: "base.s1.snmp.cpu", DataPoints: [][]*float64{{&one, &t1}, {&three, &t2}}}},
+        },
+    }
+}
+
+func TestStatisticsHandler(t *testing.T) {
+    cfg, err := parseConfig([]string{"-base-dir", "base", "-progress=false"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rec := httptest.NewRecorder()
+    statisticsHandler(cfg, memoryGraphite()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/statistics", nil))
+
+    if rec.Code != http.StatusOK {
+        t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+    }
+    if got := rec.Header().Get("Content-Type"); got != "application/json" {
+        t.Errorf("Content-Type = %q, want application/json", got)
+    }
+    if got := rec.Header().Get("X-Failures"); got != "0" {
+        t.Errorf("X-Failures = %q, want 0", got)
+    }
+
+    var out OutputFormat
+    if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+        t.Fatalf("invalid JSON body: %v", err)
+    }
+    if got := out[0]["s1"]["cpu"]; got.Count != 2 || got.Average != 2 {
+        t.Errorf("s1 cpu = %+v, want count 2, average 2", got)
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+
+    "graphite/graphite"
+)
+
+// runState is the -state-file content: the end of the time range the last
+// successful run covered.
+type runState struct {
+    Until int64 `json:"until"`
+}
+
+// errNothingNew is returned by incrementalRange when the previous run
+// already reached cfg.Until, e.g. for a rerun within the same second.
+var errNothingNew = errors.New("nothing new since the last run")
+
+// incrementalRange returns the time range of a run started at now with
+// -state-file: from the end of the previous run, or cfg.From on the first
+// run, until cfg.Until pinned to an epoch so that it can be saved exactly.
+func incrementalRange(cfg Config, now time.Time) (string, string, error) {
+    until, err := graphite.ResolveTime(cfg.Until, now)
+    if err != nil {
+        return "", "", err
+    }
+
+    from := cfg.From
+    state, err := readState(cfg.StateFile)
+    switch {
+    case errors.Is(err, fs.ErrNotExist):
+    case err != nil:
+        return "", "", err
+    default:
+        if state.Until >= until.Unix() {
+            return "", "", errNothingNew
+        }
+        from = strconv.FormatInt(state.Until, 10)
+    }
+
+    if err := graphite.ValidateRange(from, strconv.FormatInt(until.Unix(), 10), now); err != nil {
+        return "", "", fmt.Errorf("invalid -from for the first run: %v", err)
+    }
+
+    return from, strconv.FormatInt(until.Unix(), 10), nil
+}
+
+func readState(path string) (runState, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return runState{}, err
+    }
+
+    var state runState
+    if err := json.Unmarshal(data, &state); err != nil || state.Until <= 0 {
+        return runState{}, fmt.Errorf("invalid state file %s: want {\"until\": <unix time>}", path)
+    }
+
+    return state, nil
+}
+
+// writeState replaces the state file atomically, so that an interrupted
+// write cannot leave the next run without a starting point.
+func writeState(path string, state runState) error {
+    data, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(append(data, '\n')); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+
+    return os.Rename(tmp.Name(), path)
+}
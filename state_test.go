@@ -0,0 +1,127 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// renderRange returns the from and until of the last recorded /render
+// request of f.
+func renderRange(t *testing.T, f *fakeGraphite) (string, string) {
+    t.Helper()
+
+    requests := f.requested("/render")
+    if len(requests) == 0 {
+        t.Fatal("no /render request")
+    }
+    u, err := url.Parse(requests[len(requests)-1])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return u.Query().Get("from"), u.Query().Get("until")
+}
+
+func TestStateFile(t *testing.T) {
+    state := filepath.Join(t.TempDir(), "state.json")
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]"})
+    srv := newFakeGraphite(t, f)
+
+    // The first run has no state and starts at -from; it ends a minute
+    // ago so that the second, ending now, has something left to fetch.
+    before := time.Now().Add(-time.Minute).Unix()
+    runJSON(t, srv.URL, "-base-dir", "base", "-state-file", state, "-from", "-1h", "-until", "-1min")
+    from, until := renderRange(t, f)
+    firstUntil, err := strconv.ParseInt(until, 10, 64)
+    if from != "-1h" || err != nil || firstUntil < before || firstUntil > before+5 {
+        t.Fatalf("first run range = %s to %s, want -1h to about %d", from, until, before)
+    }
+    data, err := os.ReadFile(state)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := `{"until":` + until + "}\n"; string(data) != want {
+        t.Errorf("state file = %q, want %q", data, want)
+    }
+
+    runJSON(t, srv.URL, "-base-dir", "base", "-state-file", state, "-from", "-1h")
+    from, until = renderRange(t, f)
+    if from != strconv.FormatInt(firstUntil, 10) {
+        t.Errorf("second run starts at %s, want the end of the first, %d", from, firstUntil)
+    }
+    if secondUntil, _ := strconv.ParseInt(until, 10, 64); secondUntil <= firstUntil {
+        t.Errorf("second run ends at %s, want after %d", until, firstUntil)
+    }
+    data, _ = os.ReadFile(state)
+    if want := `{"until":` + until + "}\n"; string(data) != want {
+        t.Errorf("state file after the second run = %q, want %q", data, want)
+    }
+}
+
+func TestStateFileNothingNew(t *testing.T) {
+    state := writeFile(t, "state.json", `{"until": 1700003600}`)
+    output := writeFile(t, "out.json", "previous results")
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]"})
+    srv := newFakeGraphite(t, f)
+
+    // A rerun within the same second resolves -until to where the last
+    // run ended.
+    _, failures, err := run(t, srv.URL, "-base-dir", "base", "-state-file", state, "-from", "1700000000", "-until", "1700003600", "-output", output)
+    if err != nil || failures != 0 {
+        t.Fatalf("run: %d failures, error %v, want success", failures, err)
+    }
+
+    if got := f.requested("/render"); len(got) != 0 {
+        t.Errorf("render requests = %q, want none", got)
+    }
+    if data, _ := os.ReadFile(state); string(data) != `{"until": 1700003600}` {
+        t.Errorf("state file = %q, want it unchanged", data)
+    }
+    if data, _ := os.ReadFile(output); string(data) != "previous results" {
+        t.Errorf("output = %q, want it unchanged", data)
+    }
+}
+
+func TestStateFileNotAdvancedOnFailure(t *testing.T) {
+    state := writeFile(t, "state.json", `{"until": 1700000000}`)
+    f := singleServer(map[string]string{"cpu": "[[1, 100]]"})
+    srv := newFakeGraphite(t, f)
+    var from string
+    failed := failing(f, "base.s1.snmp.cpu")
+    srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/render" {
+            from = r.URL.Query().Get("from")
+        }
+        failed.ServeHTTP(w, r)
+    })
+
+    _, failures, err := run(t, srv.URL, "-base-dir", "base", "-state-file", state, "-retries", "0")
+    if err != nil || failures != 1 {
+        t.Fatalf("run: %d failures, error %v, want 1 failure", failures, err)
+    }
+
+    if from != "1700000000" {
+        t.Errorf("run starts at %s, want the state file's 1700000000", from)
+    }
+    if data, _ := os.ReadFile(state); string(data) != `{"until": 1700000000}` {
+        t.Errorf("state file = %q, want it unchanged", data)
+    }
+}
+
+func TestStateFileInvalid(t *testing.T) {
+    for _, content := range []string{`not json`, `{}`, `{"until": -5}`} {
+        state := writeFile(t, "state.json", content)
+        srv := newFakeGraphite(t, singleServer(map[string]string{"cpu": "[[1, 100]]"}))
+
+        _, _, err := run(t, srv.URL, "-base-dir", "base", "-state-file", state)
+        if err == nil || !strings.Contains(err.Error(), "invalid state file") {
+            t.Errorf("state %s: error = %v, want an invalid state file error", content, err)
+        }
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+)
+
+func newHTTPClient(cfg Config) (*http.Client, error) {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = http.ProxyFromEnvironment
+    // The default of two idle connections per host would make most of the
+    // -concurrency requests to a single Graphite open a new connection.
+    transport.MaxIdleConns = cfg.MaxIdleConns
+    transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+    if transport.MaxIdleConnsPerHost == 0 {
+        transport.MaxIdleConnsPerHost = cfg.Concurrency
+    }
+    transport.IdleConnTimeout = cfg.IdleConnTimeout
+    if cfg.Proxy != nil {
+        transport.Proxy = http.ProxyURL(cfg.Proxy)
+    }
+
+    if cfg.CACert != "" || cfg.Insecure {
+        tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+
+        if cfg.CACert != "" {
+            pem, err := os.ReadFile(cfg.CACert)
+            if err != nil {
+                return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+            }
+
+            pool := x509.NewCertPool()
+            if !pool.AppendCertsFromPEM(pem) {
+                return nil, fmt.Errorf("no valid certificates found in %s", cfg.CACert)
+            }
+            tlsConfig.RootCAs = pool
+        }
+
+        transport.TLSClientConfig = tlsConfig
+    }
+
+    return &http.Client{Timeout: cfg.Timeout, Transport: transport, CheckRedirect: checkRedirect(cfg.FollowRedirects)}, nil
+}
+
+// maxRedirects matches the limit of the default http.Client.
+const maxRedirects = 10
+
+// checkRedirect logs every redirect so that a load balancer bouncing
+// requests elsewhere does not go unnoticed. Unless follow is set, the
+// redirect response itself is returned, which the Graphite client reports
+// as an error.
+func checkRedirect(follow bool) func(*http.Request, []*http.Request) error {
+    return func(req *http.Request, via []*http.Request) error {
+        from := via[len(via)-1].URL
+        if !follow {
+            slog.Debug("not following redirect", "from", from, "to", req.URL)
+            return http.ErrUseLastResponse
+        }
+        if len(via) >= maxRedirects {
+            return fmt.Errorf("stopped after %d redirects", maxRedirects)
+        }
+
+        slog.Debug("following redirect", "from", from, "to", req.URL)
+        return nil
+    }
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+    "context"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "graphite/graphite"
+)
+
+func TestTimeout(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-r.Context().Done():
+        case <-time.After(time.Second):
+        }
+    }))
+    defer srv.Close()
+
+    cfg, err := parseConfig([]string{"-timeout", "50ms"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    httpClient, err := newHTTPClient(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := graphite.NewClient(srv.URL, httpClient)
+    client.Retries = 0
+
+    start := time.Now()
+    _, err = client.Data(context.Background(), "cpu")
+
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("Data error = %v, want a timeout", err)
+    }
+    if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+        t.Errorf("Data took %s, want about 50ms", elapsed)
+    }
+}
+
+func TestCACert(t *testing.T) {
+    srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `[{"path": "base.s1"}]`)
+    }))
+    defer srv.Close()
+
+    caCert := filepath.Join(t.TempDir(), "ca.pem")
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+    if err := os.WriteFile(caCert, certPEM, 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        args    []string
+        wantErr bool
+    }{
+        {"system roots", nil, true},
+        {"ca-cert", []string{"-ca-cert", caCert}, false},
+        {"insecure", []string{"-insecure"}, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg, err := parseConfig(tt.args)
+            if err != nil {
+                t.Fatal(err)
+            }
+            httpClient, err := newHTTPClient(cfg)
+            if err != nil {
+                t.Fatal(err)
+            }
+            client := graphite.NewClient(srv.URL, httpClient)
+            client.BaseDir = "base"
+            client.Retries = 0
+
+            _, err = client.ServerList(context.Background())
+            if (err != nil) != tt.wantErr {
+                t.Errorf("ServerList error = %v, want error %t", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestCACertInvalid(t *testing.T) {
+    caCert := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(caCert, []byte("not a certificate"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := parseConfig([]string{"-ca-cert", caCert})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := newHTTPClient(cfg); err == nil {
+        t.Error("newHTTPClient succeeded with an invalid -ca-cert")
+    }
+}
+
+func TestRateLimit(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `[]`)
+    }))
+    defer srv.Close()
+
+    cfg, err := parseConfig([]string{"-rate", "20"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    client, err := newGraphiteClient([]string{srv.URL}, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Six requests at 20 per second need at least five 50ms intervals.
+    start := time.Now()
+    for i := 0; i < 6; i++ {
+        if _, err := client.ServerList(context.Background()); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+        t.Errorf("6 requests at -rate 20 took %s, want at least 250ms", elapsed)
+    }
+}
+
+func TestProxy(t *testing.T) {
+    var proxied string
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        proxied = r.URL.String()
+        fmt.Fprint(w, `[]`)
+    }))
+    defer proxy.Close()
+
+    cfg, err := parseConfig([]string{"-proxy", proxy.URL})
+    if err != nil {
+        t.Fatal(err)
+    }
+    httpClient, err := newHTTPClient(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := graphite.NewClient("http://graphite.invalid", httpClient)
+    client.BaseDir = "base"
+
+    if _, err := client.ServerList(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if want := "http://graphite.invalid/metrics/find?query=base.*&format=json"; proxied != want {
+        t.Errorf("proxy received %q, want %q", proxied, want)
+    }
+}
+
+func TestProxyInvalid(t *testing.T) {
+    if _, err := parseConfig([]string{"-proxy", "proxy:3128"}); err == nil {
+        t.Error("parseConfig accepted a relative -proxy")
+    }
+}
+
+func TestFollowRedirects(t *testing.T) {
+    target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, `[{"target": "cpu", "datapoints": [[1, 100]]}]`)
+    }))
+    defer target.Close()
+    redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Redirect(w, r, target.URL+r.URL.RequestURI(), http.StatusFound)
+    }))
+    defer redirector.Close()
+
+    tests := []struct {
+        follow  string
+        wantErr bool
+        wantLog string
+    }{
+        {"true", false, "following redirect"},
+        {"false", true, "not following redirect"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.follow, func(t *testing.T) {
+            logs := captureLogs(t)
+            cfg, err := parseConfig([]string{"-follow-redirects=" + tt.follow})
+            if err != nil {
+                t.Fatal(err)
+            }
+            httpClient, err := newHTTPClient(cfg)
+            if err != nil {
+                t.Fatal(err)
+            }
+            client := graphite.NewClient(redirector.URL, httpClient)
+            client.Retries = 0
+
+            dataPoints, err := client.Data(context.Background(), "cpu")
+
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Data error = %v, want error %t", err, tt.wantErr)
+            }
+            if !tt.wantErr && len(dataPoints) != 1 {
+                t.Errorf("got %d series, want the redirect target's 1", len(dataPoints))
+            }
+            if got := logs.String(); !strings.Contains(got, "msg=\""+tt.wantLog+"\"") || !strings.Contains(got, "to=\""+target.URL) {
+                t.Errorf("logs = %q, want a %q record naming the target", got, tt.wantLog)
+            }
+        })
+    }
+}
+
+// connectionCounter is a Graphite stub that answers /render after a short
+// delay and counts the connections opened to it.
+func connectionCounter(t testing.TB) (*httptest.Server, *atomic.Int64) {
+    var opened atomic.Int64
+    srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(5 * time.Millisecond)
+        fmt.Fprint(w, `[{"target": "cpu", "datapoints": [[1, 100]]}]`)
+    }))
+    srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+        if state == http.StateNew {
+            opened.Add(1)
+        }
+    }
+    srv.Start()
+    t.Cleanup(srv.Close)
+
+    return srv, &opened
+}
+
+// fetchConcurrently makes rounds of n concurrent Data requests.
+func fetchConcurrently(t testing.TB, client *graphite.Client, rounds, n int) {
+    for range rounds {
+        var wg sync.WaitGroup
+        for range n {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                if _, err := client.Data(context.Background(), "cpu"); err != nil {
+                    t.Error(err)
+                }
+            }()
+        }
+        wg.Wait()
+    }
+}
+
+func TestIdleConnectionReuse(t *testing.T) {
+    const concurrency = 16
+
+    tests := []struct {
+        name        string
+        args        []string
+        wantAtMost  int64
+        wantAtLeast int64
+    }{
+        // Every round after the first reuses the connections of the first.
+        {"default", nil, concurrency, 1},
+        // With one idle connection kept, every round reopens the rest.
+        {"one idle per host", []string{"-max-idle-conns-per-host", "1"}, 3 * concurrency, 2 * concurrency},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv, opened := connectionCounter(t)
+            cfg, err := parseConfig(append([]string{"-concurrency", fmt.Sprint(concurrency)}, tt.args...))
+            if err != nil {
+                t.Fatal(err)
+            }
+            httpClient, err := newHTTPClient(cfg)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer httpClient.CloseIdleConnections()
+
+            fetchConcurrently(t, graphite.NewClient(srv.URL, httpClient), 3, concurrency)
+
+            if got := opened.Load(); got > tt.wantAtMost || got < tt.wantAtLeast {
+                t.Errorf("opened %d connections for 3 rounds of %d requests, want %d to %d", got, concurrency, tt.wantAtLeast, tt.wantAtMost)
+            }
+        })
+    }
+}
+
+func BenchmarkConcurrentFetch(b *testing.B) {
+    for _, perHost := range []int{2, 0} {
+        b.Run(fmt.Sprintf("max-idle-conns-per-host=%d", perHost), func(b *testing.B) {
+            srv, opened := connectionCounter(b)
+            cfg, err := parseConfig([]string{"-concurrency", "32", "-max-idle-conns-per-host", fmt.Sprint(perHost)})
+            if err != nil {
+                b.Fatal(err)
+            }
+            httpClient, err := newHTTPClient(cfg)
+            if err != nil {
+                b.Fatal(err)
+            }
+            defer httpClient.CloseIdleConnections()
+            client := graphite.NewClient(srv.URL, httpClient)
+
+            b.ResetTimer()
+            fetchConcurrently(b, client, b.N, 32)
+            b.ReportMetric(float64(opened.Load())/float64(b.N), "conns/op")
+        })
+    }
+}
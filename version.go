@@ -0,0 +1,21 @@
+package main
+
+import (
+    "fmt"
+    "io"
+)
+
+// Set at build time, see README.md.
+var (
+    version = "dev"
+    commit  = "unknown"
+    date    = "unknown"
+)
+
+func userAgent() string {
+    return "go-graphite-metrics/" + version
+}
+
+func printVersion(w io.Writer) {
+    fmt.Fprintf(w, "go-graphite-metrics %s (commit %s, built %s)\n", version, commit, date)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+    defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+    version, commit, date = "1.2.3", "abc1234", "2024-05-01T00:00:00Z"
+
+    var buf bytes.Buffer
+    printVersion(&buf)
+
+    if want := "go-graphite-metrics 1.2.3 (commit abc1234, built 2024-05-01T00:00:00Z)\n"; buf.String() != want {
+        t.Errorf("printVersion = %q, want %q", buf.String(), want)
+    }
+    if got := userAgent(); got != "go-graphite-metrics/1.2.3" {
+        t.Errorf("userAgent = %q, want go-graphite-metrics/1.2.3", got)
+    }
+}
+
+func TestVersionFlag(t *testing.T) {
+    cfg, err := parseConfig([]string{"-version"})
+    if err != nil || !cfg.Version {
+        t.Errorf("parseConfig(-version) = %v, %v, want Version set", cfg.Version, err)
+    }
+}